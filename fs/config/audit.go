@@ -0,0 +1,273 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// auditLogPath, if set, is appended to with one JSON line per audited
+// mutation. The special value "-" writes to stdout instead of a file.
+var auditLogPath = pflag.StringP("config-audit-log", "", "", "Write a structured, hash-chained audit log of config mutations to this file (\"-\" for stdout)")
+
+// auditSyslog additionally (or instead, if --config-audit-log is unset)
+// sends each audit entry to syslog.
+var auditSyslog = pflag.BoolP("config-audit-syslog", "", false, "Additionally send the config audit log to syslog")
+
+// AuditChange describes the before/after of a single key changing as
+// part of an audited action. Password values are redacted to
+// "*** ENCRYPTED ***" rather than recorded, same as ShowRemote.
+type AuditChange struct {
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// AuditEntry is one line of the audit log. Entries are chained by
+// PrevHash/Hash (each Hash covers the entry's own fields plus PrevHash)
+// so `rclone config audit verify` can detect a line having been edited
+// or removed after the fact.
+type AuditEntry struct {
+	Time     string                 `json:"time"`
+	Actor    string                 `json:"actor"`
+	Action   string                 `json:"action"`
+	Remote   string                 `json:"remote,omitempty"`
+	Changes  map[string]AuditChange `json:"changes,omitempty"`
+	PrevHash string                 `json:"prevHash"`
+	Hash     string                 `json:"hash"`
+}
+
+// auditMu serialises Audit calls - both to keep the hash chain
+// consistent and because os/user and the log writers below aren't
+// safe for unsynchronised concurrent use.
+var auditMu sync.Mutex
+
+// auditActor is cached the first time it's needed - the OS user
+// running rclone doesn't change mid-process.
+var auditActor string
+
+// Now returns the current time as RFC3339, the timestamp format written
+// to the audit log. It is a var so tests can stub it.
+var Now = func() string {
+	return time.Now().Format(time.RFC3339)
+}
+
+// actorName identifies who is making config changes, for the audit log:
+// the OS user rclone is running as, or "rc" if it's clear the call came
+// from the rc HTTP API (see fs/config/configrc).
+func actorName() string {
+	if auditActor != "" {
+		return auditActor
+	}
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		auditActor = u.Username
+	} else {
+		auditActor = "unknown"
+	}
+	return auditActor
+}
+
+// SetAuditActor overrides the actor name Audit records, eg so the rc
+// layer can identify its caller instead of the OS user the daemon
+// itself runs as.
+func SetAuditActor(actor string) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditActor = actor
+}
+
+// redactChange returns an AuditChange with old/new redacted to
+// "*** ENCRYPTED ***" if isPassword is set and the respective value is
+// non-empty.
+func redactChange(old, newValue string, isPassword bool) AuditChange {
+	c := AuditChange{Old: old, New: newValue}
+	if isPassword {
+		if c.Old != "" {
+			c.Old = "*** ENCRYPTED ***"
+		}
+		if c.New != "" {
+			c.New = "*** ENCRYPTED ***"
+		}
+	}
+	return c
+}
+
+// isPasswordKey reports whether key is (or looks like) a password
+// option of remote's provider, for redaction purposes. It's best-effort:
+// if remote's type can't be resolved (eg it's being deleted, or doesn't
+// exist yet), or key isn't one of its options, it falls back to
+// matching "pass" in the key name, and also treats ConfigToken as a
+// password.
+func isPasswordKey(remote, key string) bool {
+	if f, err := findByName(remote); err == nil {
+		for _, option := range f.Options {
+			if option.Name == key {
+				return option.IsPassword
+			}
+		}
+	}
+	return strings.Contains(strings.ToLower(key), "pass") || key == ConfigToken
+}
+
+// Audit records one mutation to the audit log (if configured), chaining
+// it to the previous entry's hash. Failures to write are logged but
+// never block or fail the caller - an audit trail is a nice-to-have
+// next to the mutation actually succeeding, not a gate on it.
+func Audit(action, remote string, changes map[string]AuditChange) {
+	if *auditLogPath == "" && !*auditSyslog {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	entry := AuditEntry{
+		Time:    Now(),
+		Actor:   actorName(),
+		Action:  action,
+		Remote:  remote,
+		Changes: changes,
+	}
+	entry.PrevHash = lastAuditHash()
+	entry.Hash = hashAuditEntry(entry)
+	writeAuditEntry(entry)
+	auditLastHash = entry.Hash
+}
+
+// hashAuditEntry computes the chained hash of entry: sha256 of its
+// PrevHash followed by the JSON of the whole entry with Hash cleared
+// (so the JSON includes PrevHash too).
+func hashAuditEntry(entry AuditEntry) string {
+	entry.Hash = ""
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(entry.PrevHash), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditLastHash caches the Hash of the most recently written audit
+// entry for the life of the process. Audit updates it after every
+// write, and lastAuditHash seeds it once from --config-audit-log's last
+// line if one is configured - this is what keeps entries chained when
+// writing to --config-audit-log - (stdout) or --config-audit-syslog
+// alone, neither of which can be read back the way a real file can.
+var (
+	auditLastHash     string
+	auditLastHashRead bool
+)
+
+// lastAuditHash returns the Hash of the previous audit entry, seeding
+// it from the last line of --config-audit-log (if it's a real file) the
+// first time it's called in this process.
+func lastAuditHash() string {
+	if auditLastHashRead {
+		return auditLastHash
+	}
+	auditLastHashRead = true
+	path := *auditLogPath
+	if path == "" || path == "-" {
+		return auditLastHash
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return auditLastHash
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	last := lines[len(lines)-1]
+	if last == "" {
+		return auditLastHash
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(last), &entry); err != nil {
+		return auditLastHash
+	}
+	auditLastHash = entry.Hash
+	return auditLastHash
+}
+
+// writeAuditEntry appends entry to --config-audit-log and/or syslog.
+func writeAuditEntry(entry AuditEntry) {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		fs.Errorf(nil, "Failed to marshal audit entry: %v", err)
+		return
+	}
+	switch *auditLogPath {
+	case "":
+	case "-":
+		fmt.Println(string(body))
+	default:
+		f, err := os.OpenFile(*auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			fs.Errorf(nil, "Failed to open audit log %q: %v", *auditLogPath, err)
+		} else {
+			if _, err := fmt.Fprintln(f, string(body)); err != nil {
+				fs.Errorf(nil, "Failed to write audit log %q: %v", *auditLogPath, err)
+			}
+			_ = f.Close()
+		}
+	}
+	if *auditSyslog {
+		writeSyslogAuditEntry(string(body))
+	}
+}
+
+// writeSyslogAuditEntry best-effort logs body to syslog; failures are
+// only reported via fs.Errorf, never returned, since syslog is an
+// additional sink rather than the primary record.
+func writeSyslogAuditEntry(body string) {
+	w, err := syslog.New(syslog.LOG_INFO, "rclone-config-audit")
+	if err != nil {
+		fs.Errorf(nil, "Failed to open syslog for audit log: %v", err)
+		return
+	}
+	defer func() { _ = w.Close() }()
+	if err := w.Info(body); err != nil {
+		fs.Errorf(nil, "Failed to write audit entry to syslog: %v", err)
+	}
+}
+
+// VerifyAuditLog reads every entry in --config-audit-log and checks
+// that its hash chain is unbroken, returning an error naming the first
+// line where it isn't - the back end for `rclone config audit verify`.
+func VerifyAuditLog() error {
+	path := *auditLogPath
+	if path == "" || path == "-" {
+		return errors.New("no --config-audit-log file configured to verify")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read audit log")
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	prevHash := ""
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return errors.Wrapf(err, "line %d: not valid JSON", i+1)
+		}
+		if entry.PrevHash != prevHash {
+			return errors.Errorf("line %d: prevHash %q doesn't match the hash of the previous entry %q - log has been tampered with or entries removed", i+1, entry.PrevHash, prevHash)
+		}
+		want := hashAuditEntry(entry)
+		if entry.Hash != want {
+			return errors.Errorf("line %d: hash %q doesn't match computed hash %q - entry contents have been altered", i+1, entry.Hash, want)
+		}
+		prevHash = entry.Hash
+	}
+	return nil
+}
@@ -1,4 +1,14 @@
 // Package config reads, writes and edits the config file and deals with command line flags
+//
+// This package is the non-interactive surface - pure config I/O and
+// encryption - so that it can be embedded in a GUI, a web UI or an
+// automated provisioning tool without dragging in the remote editing
+// prompts. The one prompt left here is the config password prompt:
+// loading an encrypted config that no machine/TPM key,
+// --password-command or RCLONE_CONFIG_PASS unlocks still asks for the
+// password on the terminal (see GetPassword) when fs.Config.AskPassword
+// is set. The interactive, menu-driven CLI built on top of it lives in
+// fs/config/configui.
 package config
 
 import (
@@ -7,12 +17,14 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
 	"regexp"
@@ -20,15 +32,17 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode/utf8"
 
 	"github.com/Unknwon/goconfig"
 	"github.com/ncw/rclone/fs"
 	"github.com/ncw/rclone/fs/accounting"
-	"github.com/ncw/rclone/fs/driveletter"
 	"github.com/ncw/rclone/fs/fshttp"
 	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
 	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
 	"golang.org/x/text/unicode/norm"
 )
 
@@ -53,6 +67,15 @@ const (
 
 	// ConfigAutomatic indicates that we want non-interactive configuration
 	ConfigAutomatic = "config_automatic"
+
+	// scryptSaltSize is the size of the random salt stored in a
+	// RCLONE_ENCRYPT_V1 config file
+	scryptSaltSize = 32
+
+	// scryptParamsSize is the size of the encoded scrypt cost
+	// parameters (logN, r, p as big endian uint32s) stored in a
+	// RCLONE_ENCRYPT_V1 config file
+	scryptParamsSize = 12
 )
 
 // Global
@@ -68,16 +91,328 @@ var (
 	// and any parents.
 	CacheDir = makeCacheDir()
 
-	// Key to use for password en/decryption.
+	// configKey is the key (KEK) derived from the user's password.
+	// It is only ever used to wrap/unwrap configMasterKey - it never
+	// touches the config body directly once a master key exists.
 	// When nil, no encryption will be used for saving.
 	configKey []byte
+
+	// configMasterKey is the random key that actually encrypts the
+	// config body. It is sealed with configKey and stored in the
+	// config file, so that changing the password only requires
+	// re-sealing this (small, fixed-size) key rather than
+	// re-encrypting the whole config.
+	configMasterKey []byte
+
+	// configWrappedMasterKey caches the wrappedMasterKeySize blob as
+	// last read from (or written to) the config file. SaveConfig
+	// reuses it unchanged unless it is nil, which lets configKey be
+	// wiped from memory as soon as the master key has been unwrapped
+	// rather than being kept around for every future save.
+	configWrappedMasterKey []byte
+
+	// configSalt and configScryptParams describe how configKey was
+	// derived from the user's password when the config is encrypted
+	// with RCLONE_ENCRYPT_V1.  They are written to the config file
+	// alongside the ciphertext so the key can be re-derived on load.
+	configSalt         []byte
+	configScryptParams scryptParams
+
+	// Scrypt cost parameters used when a new encryption key is
+	// derived, eg when setting a password for the first time or
+	// rotating the salt.  Tunable so users on constrained or very
+	// powerful hardware can adjust the work factor.
+	configScryptN = pflag.IntP("config-scrypt-n", "", 16, "Log2 of scrypt N parameter used to derive the config encryption key")
+	configScryptR = pflag.IntP("config-scrypt-r", "", 8, "Scrypt r parameter used to derive the config encryption key")
+	configScryptP = pflag.IntP("config-scrypt-p", "", 1, "Scrypt p parameter used to derive the config encryption key")
+
+	// configPasswordCommand, if set, is run to obtain the config
+	// password instead of prompting on stdin or reading
+	// RCLONE_CONFIG_PASS.
+	configPasswordCommand = pflag.StringP("password-command", "", "", "Command for supplying config password")
+)
+
+const (
+	// masterKeySize is the size in bytes of configMasterKey
+	masterKeySize = 32
+	// wrappedMasterKeySize is the size of the nonce+sealed blob used
+	// to store configMasterKey, sealed with configKey, in a
+	// RCLONE_ENCRYPT_V1 config file
+	wrappedMasterKeySize = 24 + masterKeySize + secretbox.Overhead
 )
 
+// scryptParams holds the scrypt cost parameters used to derive the
+// config encryption key from a password.  They are stored next to the
+// salt in a RCLONE_ENCRYPT_V1 config file so a config can always be
+// opened even if the defaults change in a later version of rclone.
+type scryptParams struct {
+	logN int
+	r    int
+	p    int
+}
+
+// defaultScryptParams returns the scrypt cost parameters to use when
+// deriving a new encryption key, taken from the --config-scrypt-*
+// flags.
+func defaultScryptParams() scryptParams {
+	return scryptParams{logN: *configScryptN, r: *configScryptR, p: *configScryptP}
+}
+
+// encode serialises the scrypt parameters as 3 big endian uint32s
+func (sp scryptParams) encode() []byte {
+	buf := make([]byte, scryptParamsSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(sp.logN))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(sp.r))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(sp.p))
+	return buf
+}
+
+// decodeScryptParams reads back the scrypt parameters encoded by encode
+func decodeScryptParams(buf []byte) scryptParams {
+	return scryptParams{
+		logN: int(binary.BigEndian.Uint32(buf[0:4])),
+		r:    int(binary.BigEndian.Uint32(buf[4:8])),
+		p:    int(binary.BigEndian.Uint32(buf[8:12])),
+	}
+}
+
+// newScryptSalt returns a fresh random salt for use with scrypt
+func newScryptSalt() ([]byte, error) {
+	salt := make([]byte, scryptSaltSize)
+	n, err := rand.Read(salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read random salt")
+	}
+	if n != scryptSaltSize {
+		return nil, errors.New("salt short read")
+	}
+	return salt, nil
+}
+
+// newMasterKey returns a fresh random master key used to encrypt the
+// config body.
+func newMasterKey() ([]byte, error) {
+	key := make([]byte, masterKeySize)
+	n, err := rand.Read(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read random master key")
+	}
+	if n != masterKeySize {
+		return nil, errors.New("master key short read")
+	}
+	return key, nil
+}
+
+// wrapMasterKey seals masterKey with kek (the password-derived
+// configKey), returning a fresh nonce followed by the sealed blob -
+// wrappedMasterKeySize bytes in total.
+func wrapMasterKey(masterKey, kek []byte) ([]byte, error) {
+	var nonce [24]byte
+	n, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read random nonce")
+	}
+	if n != 24 {
+		return nil, errors.New("nonce short read")
+	}
+	var key [32]byte
+	copy(key[:], kek[:32])
+	wrapped := make([]byte, 0, wrappedMasterKeySize)
+	wrapped = append(wrapped, nonce[:]...)
+	wrapped = secretbox.Seal(wrapped, masterKey, &nonce, &key)
+	return wrapped, nil
+}
+
+// unwrapMasterKey opens a wrappedMasterKeySize blob (as produced by
+// wrapMasterKey) with kek, returning the master key.
+func unwrapMasterKey(wrapped, kek []byte) (masterKey []byte, ok bool) {
+	if len(wrapped) != wrappedMasterKeySize {
+		return nil, false
+	}
+	var nonce [24]byte
+	copy(nonce[:], wrapped[:24])
+	var key [32]byte
+	copy(key[:], kek[:32])
+	return secretbox.Open(nil, wrapped[24:], &nonce, &key)
+}
+
+// passwordCommand returns the command to run to fetch the config
+// password, from --password-command or RCLONE_PASSWORD_COMMAND, or ""
+// if neither is set.
+func passwordCommand() string {
+	command := *configPasswordCommand
+	if command == "" {
+		command = os.Getenv("RCLONE_PASSWORD_COMMAND")
+	}
+	return command
+}
+
+// runPasswordCommand runs command via the shell and returns the
+// first line of its stdout as the password. Stderr is inherited so
+// the helper can prompt interactively (eg via a GUI pinentry) if it
+// needs to.
+func runPasswordCommand(command string) (string, error) {
+	shell, flag := "/bin/sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/c"
+	}
+	cmd := exec.Command(shell, flag, command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrap(err, "password command failed")
+	}
+	line := out
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		line = out[:i]
+	}
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return "", errors.New("password command returned no output")
+	}
+	return string(line), nil
+}
+
 func init() {
 	// Set the function pointer up in fs
 	fs.ConfigFileGet = FileGet
 }
 
+// ConfigBackend is the storage layer underneath FileGet, FileSet,
+// FileSections, FileGetKeys and Dump. The default, used when
+// --config-backend/RCLONE_CONFIG_BACKEND is unset or "file", is the
+// local rclone.conf file - handled by configData and the encryption
+// machinery above. Alternative backends (Vault, AWS Secrets Manager,
+// Kubernetes Secrets) let a multi-tenant deployment keep remote
+// credentials in a secret store instead of on local disk, while
+// presenting the same section/key API to the rest of rclone.
+type ConfigBackend interface {
+	// Get returns the stored value of key under section, and whether
+	// it was found.
+	Get(section, key string) (value string, ok bool)
+	// Set stores value under key in section, returning an error if the
+	// remote store rejected or failed to apply the write.
+	Set(section, key, value string) error
+	// DeleteKey removes key from section, returning whether it
+	// existed and an error if the remote store failed to apply the
+	// deletion.
+	DeleteKey(section, key string) (existed bool, err error)
+	// DeleteSection removes every key under section, returning an
+	// error if the remote store failed to apply the deletion.
+	DeleteSection(section string) error
+	// Sections returns the names of every configured section.
+	Sections() []string
+	// Keys returns the keys set under section.
+	Keys(section string) []string
+}
+
+// configBackendFile is the name of the default ConfigBackend.
+const configBackendFile = "file"
+
+// configBackendFlag selects an alternative ConfigBackend; see
+// backendName and newConfigBackend.
+var configBackendFlag = pflag.StringP("config-backend", "", "", "Storage backend for the config: file (default), vault, awssecretsmanager or kubernetes")
+
+// fileConfigBackend is the default ConfigBackend, backed by configData -
+// the in-memory goconfig representation of rclone.conf, loaded and
+// saved (with optional encryption) by LoadConfig/SaveConfig below.
+type fileConfigBackend struct{}
+
+func (fileConfigBackend) Get(section, key string) (string, bool) {
+	value, err := configData.GetValue(section, key)
+	return value, err == nil
+}
+
+func (fileConfigBackend) Set(section, key, value string) error {
+	return configData.SetValue(section, key, value)
+}
+
+func (fileConfigBackend) DeleteKey(section, key string) (bool, error) {
+	return configData.DeleteKey(section, key), nil
+}
+
+func (fileConfigBackend) DeleteSection(section string) error {
+	return configData.DeleteSection(section)
+}
+
+func (fileConfigBackend) Sections() []string {
+	return configData.GetSectionList()
+}
+
+func (fileConfigBackend) Keys(section string) []string {
+	return configData.GetKeyList(section)
+}
+
+// backendName returns the configured backend name from
+// --config-backend or RCLONE_CONFIG_BACKEND, defaulting to "file".
+func backendName() string {
+	name := *configBackendFlag
+	if name == "" {
+		name = os.Getenv("RCLONE_CONFIG_BACKEND")
+	}
+	if name == "" {
+		name = configBackendFile
+	}
+	return name
+}
+
+// newConfigBackend constructs the named ConfigBackend. Vault, AWS
+// Secrets Manager and Kubernetes Secrets are implemented in
+// vaultbackend.go, awssecretsmanagerbackend.go and kubernetesbackend.go
+// respectively.
+func newConfigBackend(name string) (ConfigBackend, error) {
+	switch name {
+	case "", configBackendFile:
+		return fileConfigBackend{}, nil
+	case "vault":
+		return newVaultConfigBackend()
+	case "awssecretsmanager":
+		return newAWSSecretsManagerConfigBackend()
+	case "kubernetes":
+		return newKubernetesConfigBackend()
+	default:
+		return nil, errors.Errorf("unknown config backend %q - must be %q, \"vault\", \"awssecretsmanager\" or \"kubernetes\"", name, configBackendFile)
+	}
+}
+
+var (
+	// backend is the active ConfigBackend, chosen by getBackend the
+	// first time it is needed.
+	backend ConfigBackend
+
+	// backendOnce ensures backend is only ever constructed once, even
+	// if two goroutines (eg two concurrent rc config/* calls) reach
+	// getBackend before it's set.
+	backendOnce sync.Once
+
+	// configMu guards every access to configData, the active
+	// ConfigBackend and the password/master-key state above
+	// (configKey, configMasterKey, ...). rc (see fs/config/configrc)
+	// serves config/create, config/update, config/delete etc. on their
+	// own goroutine per HTTP request, and neither goconfig.ConfigFile
+	// nor a remote ConfigBackend client is safe for unsynchronised
+	// concurrent use - without this, two racing requests can hit Go's
+	// "fatal error: concurrent map writes" and take down the whole rc
+	// daemon. Each lock/unlock below is scoped to a single
+	// configData/backend touch rather than held across a call into
+	// another locking function, so composing them (eg CreateRemote
+	// calling FileSet in a loop) can't deadlock.
+	configMu sync.Mutex
+)
+
+// getBackend returns the active ConfigBackend, constructing it (and any
+// remote client it needs) the first time it is called.
+func getBackend() ConfigBackend {
+	backendOnce.Do(func() {
+		b, err := newConfigBackend(backendName())
+		if err != nil {
+			log.Fatalf("Failed to initialise config backend: %v", err)
+		}
+		backend = b
+	})
+	return backend
+}
+
 // Return the path to the configuration file
 func makeConfigPath() string {
 	// Find user's home directory
@@ -149,6 +484,7 @@ func makeConfigPath() string {
 // LoadConfig loads the config file
 func LoadConfig() {
 	// Load configuration file.
+	configMu.Lock()
 	var err error
 	configData, err = loadConfigFile()
 	if err == errorConfigFileNotFound {
@@ -159,6 +495,7 @@ func LoadConfig() {
 	} else {
 		fs.Debugf(nil, "Using config file from %q", ConfigPath)
 	}
+	configMu.Unlock()
 
 	// Start the token bucket limiter
 	accounting.StartTokenBucket()
@@ -185,6 +522,7 @@ func loadConfigFile() (*goconfig.ConfigFile, error) {
 
 	// Find first non-empty line
 	r := bufio.NewReader(bytes.NewBuffer(b))
+	version := 0
 	for {
 		line, _, err := r.ReadLine()
 		if err != nil {
@@ -197,8 +535,13 @@ func loadConfigFile() (*goconfig.ConfigFile, error) {
 		if len(l) == 0 || strings.HasPrefix(l, ";") || strings.HasPrefix(l, "#") {
 			continue
 		}
-		// First non-empty or non-comment must be ENCRYPT_V0
+		// First non-empty or non-comment must be ENCRYPT_V0 or ENCRYPT_V1
 		if l == "RCLONE_ENCRYPT_V0:" {
+			version = 0
+			break
+		}
+		if l == "RCLONE_ENCRYPT_V1:" {
+			version = 1
 			break
 		}
 		if strings.HasPrefix(l, "RCLONE_ENCRYPT_V") {
@@ -213,75 +556,199 @@ func loadConfigFile() (*goconfig.ConfigFile, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to load base64 encoded data")
 	}
+
+	// V1 files have a random salt and the scrypt cost parameters
+	// prepended to the nonce+ciphertext.
+	var salt []byte
+	var params scryptParams
+	if version == 1 {
+		if len(box) < scryptSaltSize+scryptParamsSize {
+			return nil, errors.New("Configuration data too short")
+		}
+		salt = box[:scryptSaltSize]
+		params = decodeScryptParams(box[scryptSaltSize : scryptSaltSize+scryptParamsSize])
+		box = box[scryptSaltSize+scryptParamsSize:]
+	}
+	// V1 files additionally wrap a random master key with the
+	// password-derived configKey; the config body is always
+	// encrypted with the master key, never with configKey directly,
+	// so that changing the password never touches the body.
+	var wrappedMasterKey []byte
+	if version == 1 {
+		if len(box) < wrappedMasterKeySize {
+			return nil, errors.New("Configuration data too short")
+		}
+		wrappedMasterKey = box[:wrappedMasterKeySize]
+		box = box[wrappedMasterKeySize:]
+	}
 	if len(box) < 24+secretbox.Overhead {
 		return nil, errors.New("Configuration data too short")
 	}
-	envpw := os.Getenv("RCLONE_CONFIG_PASS")
 
-	var out []byte
+	var envpw []byte
+	if command := passwordCommand(); command != "" {
+		pw, err := runPasswordCommand(command)
+		if err != nil {
+			fs.Errorf(nil, "Failed to get password from --password-command: %v", err)
+		} else {
+			envpw = []byte(pw)
+		}
+	} else if pw, ok := os.LookupEnv("RCLONE_CONFIG_PASS"); ok {
+		envpw = []byte(pw)
+	}
+
+	// If this config was bound to the machine (see BindMachineKey) or a
+	// TPM (see BindTPMKey), the KEK lives in the OS keychain/credential
+	// store or is sealed to the TPM rather than derived from a
+	// password - try those first, in turn, so an unattended daemon can
+	// decrypt without ever being asked for a passphrase. Each candidate
+	// is only trusted once it's actually unwrapped wrappedMasterKey
+	// below; a stale binding left behind after switching from one
+	// mechanism to the other (eg BindTPMKey run after an earlier
+	// BindMachineKey was never undone) must fall through to the next
+	// candidate rather than being mistaken for a wrong password.
+	var kekCandidates [][]byte
+	if version == 1 {
+		if kek, ok := loadMachineKEK(); ok {
+			kekCandidates = append(kekCandidates, kek)
+		}
+		if kek, ok := loadTPMKEK(); ok {
+			kekCandidates = append(kekCandidates, kek)
+		}
+	}
+
+	var password []byte
 	for {
-		if len(configKey) == 0 && envpw != "" {
-			err := setConfigPassword(envpw)
+		triedKEKCandidate := false
+		if len(configKey) == 0 && len(kekCandidates) != 0 {
+			configKey, kekCandidates = kekCandidates[0], kekCandidates[1:]
+			triedKEKCandidate = true
+		}
+		if len(configKey) == 0 && len(envpw) != 0 {
+			var err error
+			if version == 1 {
+				err = setConfigPasswordWithSalt(envpw, salt, params)
+			} else {
+				err = setConfigPasswordV0(envpw)
+			}
 			if err != nil {
-				fmt.Println("Using RCLONE_CONFIG_PASS returned:", err)
+				fmt.Println("Using password from --password-command/RCLONE_CONFIG_PASS returned:", err)
 			} else {
-				fs.Debugf(nil, "Using RCLONE_CONFIG_PASS password.")
+				fs.Debugf(nil, "Using password from --password-command/RCLONE_CONFIG_PASS.")
+				// Copy rather than alias envpw - they are zeroed independently
+				password = append([]byte(nil), envpw...)
 			}
 		}
 		if len(configKey) == 0 {
 			if !fs.Config.AskPassword {
-				return nil, errors.New("unable to decrypt configuration and not allowed to ask for password - set RCLONE_CONFIG_PASS to your configuration password")
+				return nil, errors.New("unable to decrypt configuration and not allowed to ask for password - set --password-command or RCLONE_CONFIG_PASS to your configuration password")
 			}
-			getConfigPassword("Enter configuration password:")
+			password = getConfigPassword("Enter configuration password:", version, salt, params)
 		}
 
-		// Nonce is first 24 bytes of the ciphertext
-		var nonce [24]byte
-		copy(nonce[:], box[:24])
-		var key [32]byte
-		copy(key[:], configKey[:32])
-
-		// Attempt to decrypt
-		var ok bool
-		out, ok = secretbox.Open(nil, box[24:], &nonce, &key)
-		if ok {
+		if version == 1 {
+			// Verify the password by unwrapping the master key with it
+			masterKey, ok := unwrapMasterKey(wrappedMasterKey, configKey)
+			if ok {
+				configMasterKey = masterKey
+				// Cache the wrap as read from disk so SaveConfig can
+				// reuse it unchanged; this lets us wipe configKey now
+				// instead of keeping it around for the life of the
+				// process just in case of a future save.
+				configWrappedMasterKey = append([]byte(nil), wrappedMasterKey...)
+				Zero(configKey)
+				configKey = nil
+				break
+			}
+		} else {
+			// V0 has no wrapped master key - configKey *is* the body
+			// key, and is still needed until the V1 upgrade below
+			// re-wraps it, so it isn't zeroed here.
+			configMasterKey = configKey
 			break
 		}
 
 		// Retry
-		fs.Errorf(nil, "Couldn't decrypt configuration, most likely wrong password.")
+		if triedKEKCandidate {
+			fs.Debugf(nil, "Stale or non-matching machine/TPM key found, trying the next configured source.")
+		} else {
+			fs.Errorf(nil, "Couldn't decrypt configuration, most likely wrong password.")
+			// Only drop envpw once it has actually been tried
+			Zero(envpw)
+			envpw = nil
+		}
+		Zero(configKey)
 		configKey = nil
-		envpw = ""
 	}
+	Zero(envpw)
+
+	// Nonce is the first 24 bytes of what remains of the ciphertext
+	var nonce [24]byte
+	copy(nonce[:], box[:24])
+	var key [32]byte
+	copy(key[:], configMasterKey[:32])
+
+	out, ok := secretbox.Open(nil, box[24:], &nonce, &key)
+	if !ok {
+		return nil, errors.New("Configuration data corrupted - master key didn't decrypt config body")
+	}
+
+	// A V0 (legacy sha256) config is transparently upgraded to V1
+	// (scrypt KEK + wrapped random master key) in memory; the next
+	// SaveConfig call will write it back out in the new format.
+	if version == 0 && len(password) != 0 {
+		masterKey, err := newMasterKey()
+		if err != nil {
+			fs.Errorf(nil, "Failed to upgrade config encryption to V1: %v", err)
+		} else if err := setConfigPassword(password); err != nil {
+			fs.Errorf(nil, "Failed to upgrade config encryption to V1: %v", err)
+		} else {
+			configMasterKey = masterKey
+			fs.Debugf(nil, "Config encryption will be upgraded to RCLONE_ENCRYPT_V1 on next save")
+		}
+	}
+	Zero(password)
+
 	return goconfig.LoadFromReader(bytes.NewBuffer(out))
 }
 
-// checkPassword normalises and validates the password
-func checkPassword(password string) (string, error) {
-	if !utf8.ValidString(password) {
-		return "", errors.New("password contains invalid utf8 characters")
+// Zero overwrites b with zero bytes so a short-lived secret (a
+// password or key) doesn't linger readable in the heap, eg in a core
+// dump or a later memory scan, after its owner is done with it.
+// Immutable Go strings can't be wiped this way, which is why
+// passwords are handled as []byte throughout this package.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// CheckPassword normalises and validates the password
+func CheckPassword(password []byte) ([]byte, error) {
+	if !utf8.Valid(password) {
+		return nil, errors.New("password contains invalid utf8 characters")
 	}
 	// Check for leading/trailing whitespace
-	trimmedPassword := strings.TrimSpace(password)
+	trimmedPassword := bytes.TrimSpace(password)
 	// Warn user if password has leading+trailing whitespace
 	if len(password) != len(trimmedPassword) {
 		fmt.Fprintln(os.Stderr, "Your password contains leading/trailing whitespace - in previous versions of rclone this was stripped")
 	}
 	// Normalize to reduce weird variations.
-	password = norm.NFKC.String(password)
-	if len(password) == 0 || len(trimmedPassword) == 0 {
-		return "", errors.New("no characters in password")
+	password = norm.NFKC.Bytes(password)
+	if len(trimmedPassword) == 0 {
+		return nil, errors.New("no characters in password")
 	}
 	return password, nil
 }
 
 // GetPassword asks the user for a password with the prompt given.
-func GetPassword(prompt string) string {
+func GetPassword(prompt string) []byte {
 	fmt.Fprintln(os.Stderr, prompt)
 	for {
 		fmt.Fprint(os.Stderr, "password:")
 		password := ReadPassword()
-		password, err := checkPassword(password)
+		password, err := CheckPassword(password)
 		if err == nil {
 			return password
 		}
@@ -289,46 +756,49 @@ func GetPassword(prompt string) string {
 	}
 }
 
-// ChangePassword will query the user twice for the named password. If
-// the same password is entered it is returned.
-func ChangePassword(name string) string {
-	for {
-		a := GetPassword(fmt.Sprintf("Enter %s password:", name))
-		b := GetPassword(fmt.Sprintf("Confirm %s password:", name))
-		if a == b {
-			return a
-		}
-		fmt.Println("Passwords do not match!")
-	}
-}
-
-// getConfigPassword will query the user for a password the
-// first time it is required.
-func getConfigPassword(q string) {
+// getConfigPassword will query the user for a password the first
+// time it is required, deriving configKey from it according to
+// version (0 for the legacy sha256 KDF, 1 for scrypt with the given
+// salt and params). It returns the password entered, if any.
+func getConfigPassword(q string, version int, salt []byte, params scryptParams) []byte {
 	if len(configKey) != 0 {
-		return
+		return nil
 	}
 	for {
 		password := GetPassword(q)
-		err := setConfigPassword(password)
+		var err error
+		if version == 1 {
+			err = setConfigPasswordWithSalt(password, salt, params)
+		} else {
+			err = setConfigPasswordV0(password)
+		}
 		if err == nil {
-			return
+			return password
 		}
 		fmt.Fprintln(os.Stderr, "Error:", err)
 	}
 }
 
-// setConfigPassword will set the configKey to the hash of
-// the password. If the length of the password is
-// zero after trimming+normalization, an error is returned.
-func setConfigPassword(password string) error {
-	password, err := checkPassword(password)
+// setConfigPasswordV0 will set configKey to the sha256 hash of the
+// password, the scheme used by the legacy RCLONE_ENCRYPT_V0 config
+// format. If the length of the password is zero after
+// trimming+normalization, an error is returned.
+func setConfigPasswordV0(password []byte) error {
+	password, err := CheckPassword(password)
 	if err != nil {
 		return err
 	}
-	// Create SHA256 has of the password
+	// Create SHA256 hash of the password
 	sha := sha256.New()
-	_, err = sha.Write([]byte("[" + password + "][rclone-config]"))
+	_, err = sha.Write([]byte("["))
+	if err != nil {
+		return err
+	}
+	_, err = sha.Write(password)
+	if err != nil {
+		return err
+	}
+	_, err = sha.Write([]byte("][rclone-config]"))
 	if err != nil {
 		return err
 	}
@@ -336,20 +806,145 @@ func setConfigPassword(password string) error {
 	return nil
 }
 
-// changeConfigPassword will query the user twice
-// for a password. If the same password is entered
-// twice the key is updated.
-func changeConfigPassword() {
-	err := setConfigPassword(ChangePassword("NEW configuration"))
+// setConfigPasswordWithSalt derives configKey from password using
+// scrypt with the given salt and cost parameters, the scheme used by
+// the RCLONE_ENCRYPT_V1 config format. If the length of the password
+// is zero after trimming+normalization, an error is returned.
+func setConfigPasswordWithSalt(password []byte, salt []byte, params scryptParams) error {
+	password, err := CheckPassword(password)
 	if err != nil {
-		fmt.Printf("Failed to set config password: %v\n", err)
-		return
+		return err
+	}
+	key, err := scrypt.Key(password, salt, 1<<uint(params.logN), params.r, params.p, 32)
+	if err != nil {
+		return errors.Wrap(err, "failed to derive configuration key")
+	}
+	configKey = key
+	configSalt = salt
+	configScryptParams = params
+	return nil
+}
+
+// setConfigPassword derives a new configKey from password using
+// scrypt with a freshly generated salt and the current
+// --config-scrypt-* cost parameters (RCLONE_ENCRYPT_V1). Use this
+// whenever a password is established or changed; use
+// setConfigPasswordWithSalt to re-derive the key for an existing salt
+// read from a config file. If the length of the password is zero
+// after trimming+normalization, an error is returned.
+func setConfigPassword(password []byte) error {
+	salt, err := newScryptSalt()
+	if err != nil {
+		return err
+	}
+	return setConfigPasswordWithSalt(password, salt, defaultScryptParams())
+}
+
+// IsEncrypted returns true if the config is currently encrypted, ie a
+// master key has been established by LoadConfig or
+// ChangeConfigPassword.
+func IsEncrypted() bool {
+	return len(configMasterKey) > 0
+}
+
+// ChangeConfigPassword rewraps the master key (creating one first if
+// the config isn't encrypted yet) under a freshly derived key for
+// newPassword. The config body is never touched, so this is cheap and
+// safe to call regardless of how large the config is.
+//
+// This also removes any existing machine or TPM binding, since once
+// the config is password-protected those stale entries would
+// otherwise still be picked up (and fail to unwrap) the next time
+// loadConfigFile looks for a KEK.
+func ChangeConfigPassword(newPassword []byte) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if len(configMasterKey) == 0 {
+		masterKey, err := newMasterKey()
+		if err != nil {
+			return err
+		}
+		configMasterKey = masterKey
+	}
+	configWrappedMasterKey = nil
+	if err := setConfigPassword(newPassword); err != nil {
+		return err
+	}
+	if err := UnbindMachineKey(); err != nil {
+		fs.Errorf(nil, "Failed to remove superseded machine key: %v", err)
+	}
+	if err := UnbindTPMKey(); err != nil {
+		fs.Errorf(nil, "Failed to remove superseded TPM key: %v", err)
+	}
+	Audit("SetPassword", "", nil)
+	return nil
+}
+
+// ChangeMasterKey replaces the master key that encrypts the config
+// body with a freshly generated one, sealed with the key derived from
+// currentPassword. Unlike ChangeConfigPassword this does force the
+// config body to be re-encrypted (under the new key) on the next
+// SaveConfig, so it should only be used for the rare case of rotating
+// a potentially compromised master key.
+//
+// currentPassword is needed because loadConfigFile zeroes configKey as
+// soon as the master key has been unwrapped with it, so by the time a
+// caller can reach ChangeMasterKey in the normal "open config, then
+// rotate" flow there's nothing left in memory to rewrap with.
+func ChangeMasterKey(currentPassword []byte) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if len(configMasterKey) == 0 {
+		return errors.New("config is not encrypted - nothing to rotate")
+	}
+	if len(configKey) == 0 {
+		if len(configSalt) != scryptSaltSize {
+			return errors.New("no config password set - can't rewrap a master key")
+		}
+		if err := setConfigPasswordWithSalt(currentPassword, configSalt, configScryptParams); err != nil {
+			return err
+		}
+		if _, ok := unwrapMasterKey(configWrappedMasterKey, configKey); !ok {
+			Zero(configKey)
+			configKey = nil
+			return errors.New("wrong configuration password")
+		}
+	}
+	masterKey, err := newMasterKey()
+	if err != nil {
+		return err
 	}
+	configMasterKey = masterKey
+	configWrappedMasterKey = nil
+	return nil
+}
+
+// ClearConfigPassword removes config encryption entirely. The next
+// SaveConfig call will write the config file in plain text. This also
+// removes any existing machine or TPM binding, since leaving one in
+// place would seal a KEK that no longer protects anything.
+func ClearConfigPassword() {
+	configMu.Lock()
+	defer configMu.Unlock()
+	Zero(configKey)
+	configKey = nil
+	Zero(configMasterKey)
+	configMasterKey = nil
+	configWrappedMasterKey = nil
+	if err := UnbindMachineKey(); err != nil {
+		fs.Errorf(nil, "Failed to remove machine key: %v", err)
+	}
+	if err := UnbindTPMKey(); err != nil {
+		fs.Errorf(nil, "Failed to remove TPM key: %v", err)
+	}
+	Audit("ClearPassword", "", nil)
 }
 
 // SaveConfig saves configuration file.
-// if configKey has been set, the file will be encrypted.
+// if configMasterKey has been set, the file will be encrypted.
 func SaveConfig() {
+	configMu.Lock()
+	defer configMu.Unlock()
 	dir, name := filepath.Split(ConfigPath)
 	f, err := ioutil.TempFile(dir, name)
 	if err != nil {
@@ -368,14 +963,54 @@ func SaveConfig() {
 		log.Fatalf("Failed to save config file: %v", err)
 	}
 
-	if len(configKey) == 0 {
+	if len(configMasterKey) == 0 {
 		if _, err := buf.WriteTo(f); err != nil {
 			log.Fatalf("Failed to write temp config file: %v", err)
 		}
 	} else {
 		fmt.Fprintln(f, "# Encrypted rclone configuration File")
 		fmt.Fprintln(f, "")
-		fmt.Fprintln(f, "RCLONE_ENCRYPT_V0:")
+		fmt.Fprintln(f, "RCLONE_ENCRYPT_V1:")
+
+		// Salt and scrypt parameters were set when the password was
+		// established (or re-established on a V0 -> V1 upgrade); fall
+		// back to generating them now just in case configKey was set
+		// by some other path.
+		if len(configSalt) != scryptSaltSize {
+			var err error
+			configSalt, err = newScryptSalt()
+			if err != nil {
+				log.Fatalf("Failed to generate salt for config file: %v", err)
+			}
+			configScryptParams = defaultScryptParams()
+		}
+
+		enc := base64.NewEncoder(base64.StdEncoding, f)
+		_, err = enc.Write(configSalt)
+		if err != nil {
+			log.Fatalf("Failed to write temp config file: %v", err)
+		}
+		_, err = enc.Write(configScryptParams.encode())
+		if err != nil {
+			log.Fatalf("Failed to write temp config file: %v", err)
+		}
+
+		// The master key is sealed with configKey (the password-derived
+		// KEK) - only this small blob needs rewriting when the
+		// password changes, never the config body below. Re-use the
+		// cached wrap whenever possible since configKey is wiped from
+		// memory as soon as it isn't needed any more.
+		if configWrappedMasterKey == nil {
+			wrapped, err := wrapMasterKey(configMasterKey, configKey)
+			if err != nil {
+				log.Fatalf("Failed to wrap config master key: %v", err)
+			}
+			configWrappedMasterKey = wrapped
+		}
+		_, err = enc.Write(configWrappedMasterKey)
+		if err != nil {
+			log.Fatalf("Failed to write temp config file: %v", err)
+		}
 
 		// Generate new nonce and write it to the start of the ciphertext
 		var nonce [24]byte
@@ -383,14 +1018,13 @@ func SaveConfig() {
 		if n != 24 {
 			log.Fatalf("nonce short read: %d", n)
 		}
-		enc := base64.NewEncoder(base64.StdEncoding, f)
 		_, err = enc.Write(nonce[:])
 		if err != nil {
 			log.Fatalf("Failed to write temp config file: %v", err)
 		}
 
 		var key [32]byte
-		copy(key[:], configKey[:32])
+		copy(key[:], configMasterKey[:32])
 
 		b := secretbox.Seal(nil, buf.Bytes(), &nonce, &key)
 		_, err = enc.Write(b)
@@ -436,25 +1070,33 @@ func SaveConfig() {
 // value in the config file.  It loads the old config file in from
 // disk first and overwrites the given value only.
 func SetValueAndSave(name, key, value string) (err error) {
+	// configMu is released before the SaveConfig call below, since that
+	// locks it again itself - held only across the configData reads and
+	// writes here.
+	configMu.Lock()
 	// Set the value in config in case we fail to reload it
 	configData.SetValue(name, key, value)
 	// Reload the config file
 	reloadedConfigFile, err := loadConfigFile()
 	if err == errorConfigFileNotFound {
 		// Config file not written yet so ignore reload
+		configMu.Unlock()
 		return nil
 	} else if err != nil {
+		configMu.Unlock()
 		return err
 	}
 	_, err = reloadedConfigFile.GetSection(name)
 	if err != nil {
 		// Section doesn't exist yet so ignore reload
+		configMu.Unlock()
 		return err
 	}
 	// Update the config file with the reloaded version
 	configData = reloadedConfigFile
 	// Set the value in the reloaded version
 	reloadedConfigFile.SetValue(name, key, value)
+	configMu.Unlock()
 	// Save it again
 	SaveConfig()
 	return nil
@@ -462,7 +1104,9 @@ func SetValueAndSave(name, key, value string) (err error) {
 
 // ShowRemotes shows an overview of the config file
 func ShowRemotes() {
+	configMu.Lock()
 	remotes := configData.GetSectionList()
+	configMu.Unlock()
 	if len(remotes) == 0 {
 		return
 	}
@@ -474,136 +1118,15 @@ func ShowRemotes() {
 	}
 }
 
-// ChooseRemote chooses a remote name
-func ChooseRemote() string {
-	remotes := configData.GetSectionList()
-	sort.Strings(remotes)
-	return Choose("remote", remotes, nil, false)
-}
-
-// ReadLine reads some input
-var ReadLine = func() string {
-	buf := bufio.NewReader(os.Stdin)
-	line, err := buf.ReadString('\n')
-	if err != nil {
-		log.Fatalf("Failed to read line: %v", err)
-	}
-	return strings.TrimSpace(line)
-}
-
-// Command - choose one
-func Command(commands []string) byte {
-	opts := []string{}
-	for _, text := range commands {
-		fmt.Printf("%c) %s\n", text[0], text[1:])
-		opts = append(opts, text[:1])
-	}
-	optString := strings.Join(opts, "")
-	optHelp := strings.Join(opts, "/")
-	for {
-		fmt.Printf("%s> ", optHelp)
-		result := strings.ToLower(ReadLine())
-		if len(result) != 1 {
-			continue
-		}
-		i := strings.Index(optString, string(result[0]))
-		if i >= 0 {
-			return result[0]
-		}
-	}
-}
-
-// Confirm asks the user for Yes or No and returns true or false
-func Confirm() bool {
-	if fs.Config.AutoConfirm {
-		return true
-	}
-	return Command([]string{"yYes", "nNo"}) == 'y'
-}
-
-// Choose one of the defaults or type a new string if newOk is set
-func Choose(what string, defaults, help []string, newOk bool) string {
-	valueDescripton := "an existing"
-	if newOk {
-		valueDescripton = "your own"
-	}
-	fmt.Printf("Choose a number from below, or type in %s value\n", valueDescripton)
-	for i, text := range defaults {
-		var lines []string
-		if help != nil {
-			parts := strings.Split(help[i], "\n")
-			lines = append(lines, parts...)
-		}
-		lines = append(lines, fmt.Sprintf("%q", text))
-		pos := i + 1
-		if len(lines) == 1 {
-			fmt.Printf("%2d > %s\n", pos, text)
-		} else {
-			mid := (len(lines) - 1) / 2
-			for i, line := range lines {
-				var sep rune
-				switch i {
-				case 0:
-					sep = '/'
-				case len(lines) - 1:
-					sep = '\\'
-				default:
-					sep = '|'
-				}
-				number := "  "
-				if i == mid {
-					number = fmt.Sprintf("%2d", pos)
-				}
-				fmt.Printf("%s %c %s\n", number, sep, line)
-			}
-		}
-	}
-	for {
-		fmt.Printf("%s> ", what)
-		result := ReadLine()
-		i, err := strconv.Atoi(result)
-		if err != nil {
-			if newOk {
-				return result
-			}
-			for _, v := range defaults {
-				if result == v {
-					return result
-				}
-			}
-			continue
-		}
-		if i >= 1 && i <= len(defaults) {
-			return defaults[i-1]
-		}
-	}
-}
-
-// ChooseNumber asks the user to enter a number between min and max
-// inclusive prompting them with what.
-func ChooseNumber(what string, min, max int) int {
-	for {
-		fmt.Printf("%s> ", what)
-		result := ReadLine()
-		i, err := strconv.Atoi(result)
-		if err != nil {
-			fmt.Printf("Bad number: %v\n", err)
-			continue
-		}
-		if i < min || i > max {
-			fmt.Printf("Out of range - %d to %d inclusive\n", min, max)
-			continue
-		}
-		return i
-	}
-}
-
 // ShowRemote shows the contents of the remote
 func ShowRemote(name string) {
 	fmt.Printf("--------------------\n")
 	fmt.Printf("[%s]\n", name)
 	fs := MustFindByName(name)
-	for _, key := range configData.GetKeyList(name) {
+	configMu.Lock()
+	keys := configData.GetKeyList(name)
+	configMu.Unlock()
+	for _, key := range keys {
 		isPassword := false
 		for _, option := range fs.Options {
 			if option.Name == key && option.IsPassword {
@@ -621,21 +1144,17 @@ func ShowRemote(name string) {
 	fmt.Printf("--------------------\n")
 }
 
-// OkRemote prints the contents of the remote and ask if it is OK
-func OkRemote(name string) bool {
-	ShowRemote(name)
-	switch i := Command([]string{"yYes this is OK", "eEdit this remote", "dDelete this remote"}); i {
-	case 'y':
-		return true
-	case 'e':
-		return false
-	case 'd':
-		configData.DeleteSection(name)
-		return true
-	default:
-		fs.Errorf(nil, "Bad choice %c", i)
+// findByName finds the RegInfo for the remote name passed in, or
+// returns an error if name isn't a configured remote. Unlike
+// MustFindByName it never exits the process, so it can be used from
+// automation paths such as UpdateRemote and PasswordRemote that need to
+// report failures rather than crash on them.
+func findByName(name string) (*fs.RegInfo, error) {
+	fsType := FileGet(name, "type")
+	if fsType == "" {
+		return nil, errors.Errorf("couldn't find type of fs for %q", name)
 	}
-	return false
+	return fs.Find(fsType)
 }
 
 // MustFindByName finds the RegInfo for the remote name passed in or
@@ -657,106 +1176,158 @@ func RemoteConfig(name string) {
 	}
 }
 
-// ChooseOption asks the user to choose an option
-func ChooseOption(o *fs.Option) string {
-	fmt.Println(o.Help)
-	if o.IsPassword {
-		actions := []string{"yYes type in my own password", "gGenerate random password"}
-		if o.Optional {
-			actions = append(actions, "nNo leave this optional password blank")
-		}
-		var password string
-		switch i := Command(actions); i {
-		case 'y':
-			password = ChangePassword("the")
-		case 'g':
-			for {
-				fmt.Printf("Password strength in bits.\n64 is just about memorable\n128 is secure\n1024 is the maximum\n")
-				bits := ChooseNumber("Bits", 64, 1024)
-				bytes := bits / 8
-				if bits%8 != 0 {
-					bytes++
-				}
-				var pw = make([]byte, bytes)
-				n, _ := rand.Read(pw)
-				if n != bytes {
-					log.Fatalf("password short read: %d", n)
-				}
-				password = base64.RawURLEncoding.EncodeToString(pw)
-				fmt.Printf("Your password is: %s\n", password)
-				fmt.Printf("Use this password?\n")
-				if Confirm() {
+// CreateOptions alters how CreateRemote, UpdateRemote and PasswordRemote
+// apply the params passed to them, so that a provisioning tool driving
+// them doesn't need to replicate what the interactive configui flows do
+// by hand.
+type CreateOptions struct {
+	// NoObscure stores password options in params verbatim instead of
+	// obscuring them - for callers (eg the rc layer) that have already
+	// obscured the value themselves.
+	NoObscure bool `json:"noObscure,omitempty"`
+
+	// Token, if set, is stored under ConfigToken before the provider's
+	// Config hook runs, so an OAuth token obtained out-of-band (eg by
+	// a provisioning tool driving its own browser flow) can be supplied
+	// without rclone running an interactive Authorize.
+	Token string `json:"token,omitempty"`
+
+	// NoConfigHook skips calling the provider's Config hook altogether.
+	// Combine with Token for an OAuth provider whose token never needs
+	// refreshing, or just leave unset for providers with no hook.
+	NoConfigHook bool `json:"noConfigHook,omitempty"`
+
+	// DryRun, if set, looks up the provider (and for UpdateRemote and
+	// PasswordRemote the existing remote) and returns the config that
+	// would be written, without changing configData or touching disk.
+	// The keys in params are not checked against the provider's options.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// resolveParams obscures the values in params of any password option f
+// advertises (unless opts.NoObscure), adds opts.Token if set, and
+// returns the config that would actually be written for them. It is the
+// non-interactive equivalent of configui's ChooseOption. Keys that are
+// not options of f are passed through unchanged; nothing in params is
+// rejected, so the returned error is always nil.
+func resolveParams(f *fs.RegInfo, params map[string]string, opts CreateOptions) (map[string]string, error) {
+	resolved := make(map[string]string, len(params)+1)
+	for key, value := range params {
+		if !opts.NoObscure && value != "" {
+			for _, option := range f.Options {
+				if option.Name == key && option.IsPassword {
+					value = MustObscure(value)
 					break
 				}
 			}
-		case 'n':
-			return ""
-		default:
-			fs.Errorf(nil, "Bad choice %c", i)
-		}
-		return MustObscure(password)
-	}
-	if len(o.Examples) > 0 {
-		var values []string
-		var help []string
-		for _, example := range o.Examples {
-			values = append(values, example.Value)
-			help = append(help, example.Help)
 		}
-		return Choose(o.Name, values, help, true)
+		resolved[key] = value
+	}
+	if opts.Token != "" {
+		resolved[ConfigToken] = opts.Token
 	}
-	fmt.Printf("%s> ", o.Name)
-	return ReadLine()
+	return resolved, nil
 }
 
-// UpdateRemote adds the keyValues passed in to the remote of name.
-// keyValues should be key, value pairs.
-func UpdateRemote(name string, keyValues []string) error {
-	if len(keyValues)%2 != 0 {
-		return errors.New("found key without value")
+// CreateRemote creates a new remote called name, of the given provider
+// type, with params as its options. Unless opts.DryRun is set it writes
+// the config to disk, including running the provider's Config hook
+// (unless opts.NoConfigHook) exactly as the interactive NewRemote flow
+// in configui does - but since every parameter is supplied up front, it
+// never blocks on a prompt, which lets orchestrators such as Ansible,
+// Terraform or a Kubernetes operator provision remotes headlessly.
+//
+// It returns the resolved config (with passwords obscured) that was, or
+// in dry-run mode would be, written.
+func CreateRemote(name, provider string, params map[string]string, opts CreateOptions) (map[string]string, error) {
+	f, err := fs.Find(provider)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown provider %q", provider)
+	}
+	resolved, err := resolveParams(f, params, opts)
+	if err != nil {
+		return nil, err
 	}
-	// Set the config
-	for i := 0; i < len(keyValues); i += 2 {
-		configData.SetValue(name, keyValues[i], keyValues[i+1])
+	resolved["type"] = provider
+	resolved[ConfigAutomatic] = "yes"
+	if opts.DryRun {
+		return resolved, nil
+	}
+	// Suppress Confirm
+	fs.Config.AutoConfirm = true
+	// Delete the old config if it exists
+	if err := deleteSection("CreateRemote", name); err != nil {
+		return nil, errors.Wrap(err, "failed to delete existing remote config")
+	}
+	for key, value := range resolved {
+		if err := FileSet(name, key, value); err != nil {
+			return nil, errors.Wrapf(err, "failed to save %q", key)
+		}
+	}
+	if !opts.NoConfigHook && f.Config != nil {
+		f.Config(name)
 	}
-	RemoteConfig(name)
-	ShowRemote(name)
 	SaveConfig()
-	return nil
+	return resolved, nil
 }
 
-// CreateRemote creates a new remote with name, provider and a list of
-// parameters which are key, value pairs.  If update is set then it
-// adds the new keys rather than replacing all of them.
-func CreateRemote(name string, provider string, keyValues []string) error {
-	// Suppress Confirm
+// UpdateRemote merges params into the existing remote called name,
+// applying the same obscuring and (unless opts.NoConfigHook) provider
+// Config hook as CreateRemote. It returns the resolved config (with
+// passwords obscured) that was, or in dry-run mode would be, merged in.
+func UpdateRemote(name string, params map[string]string, opts CreateOptions) (map[string]string, error) {
+	f, err := findByName(name)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := resolveParams(f, params, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		return resolved, nil
+	}
 	fs.Config.AutoConfirm = true
-	// Delete the old config if it exists
-	configData.DeleteSection(name)
-	// Set the type
-	configData.SetValue(name, "type", provider)
-	// Show this is automatically configured
-	configData.SetValue(name, ConfigAutomatic, "yes")
-	// Set the remaining values
-	return UpdateRemote(name, keyValues)
+	for key, value := range resolved {
+		if err := FileSet(name, key, value); err != nil {
+			return nil, errors.Wrapf(err, "failed to save %q", key)
+		}
+	}
+	if !opts.NoConfigHook && f.Config != nil {
+		f.Config(name)
+	}
+	SaveConfig()
+	return resolved, nil
 }
 
-// PasswordRemote adds the keyValues passed in to the remote of name.
-// keyValues should be key, value pairs.
-func PasswordRemote(name string, keyValues []string) error {
-	if len(keyValues) != 2 {
-		return errors.New("found key without value")
+// PasswordRemote sets password options on the existing remote called
+// name, obscuring every value in params regardless of opts.NoObscure -
+// unlike CreateRemote/UpdateRemote, callers of PasswordRemote always
+// pass plaintext. It returns the resolved (obscured) config that was, or
+// in dry-run mode would be, merged in.
+func PasswordRemote(name string, params map[string]string, opts CreateOptions) (map[string]string, error) {
+	if _, err := findByName(name); err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]string, len(params))
+	for key, value := range params {
+		if value == "" {
+			continue
+		}
+		resolved[key] = MustObscure(value)
+	}
+	if opts.DryRun {
+		return resolved, nil
 	}
-	// Suppress Confirm
 	fs.Config.AutoConfirm = true
-	passwd := MustObscure(keyValues[1])
-	if passwd != "" {
-		configData.SetValue(name, keyValues[0], passwd)
-		RemoteConfig(name)
-		ShowRemote(name)
-		SaveConfig()
+	for key, value := range resolved {
+		if err := FileSet(name, key, value); err != nil {
+			return nil, errors.Wrapf(err, "failed to save %q", key)
+		}
 	}
-	return nil
+	RemoteConfig(name)
+	SaveConfig()
+	return resolved, nil
 }
 
 // JSONListProviders prints all the providers and options in JSON format
@@ -772,114 +1343,55 @@ func JSONListProviders() error {
 	return nil
 }
 
-// fsOption returns an Option describing the possible remotes
-func fsOption() *fs.Option {
-	o := &fs.Option{
-		Name: "Storage",
-		Help: "Type of storage to configure.",
-	}
-	for _, item := range fs.Registry {
-		example := fs.OptionExample{
-			Value: item.Name,
-			Help:  item.Description,
-		}
-		o.Examples = append(o.Examples, example)
-	}
-	o.Examples.Sort()
-	return o
-}
-
-// NewRemoteName asks the user for a name for a remote
-func NewRemoteName() (name string) {
-	for {
-		fmt.Printf("name> ")
-		name = ReadLine()
-		parts := fs.Matcher.FindStringSubmatch(name + ":")
-		switch {
-		case name == "":
-			fmt.Printf("Can't use empty name.\n")
-		case driveletter.IsDriveLetter(name):
-			fmt.Printf("Can't use %q as it can be confused a drive letter.\n", name)
-		case parts == nil:
-			fmt.Printf("Can't use %q as it has invalid characters in it.\n", name)
-		default:
-			return name
-		}
-	}
-}
-
-// NewRemote make a new remote from its name
-func NewRemote(name string) {
-	newType := ChooseOption(fsOption())
-	configData.SetValue(name, "type", newType)
-	fs := fs.MustFind(newType)
-	for _, option := range fs.Options {
-		configData.SetValue(name, option.Name, ChooseOption(&option))
-	}
-	RemoteConfig(name)
-	if OkRemote(name) {
-		SaveConfig()
+// DeleteRemote deletes a remote
+func DeleteRemote(name string) {
+	if err := deleteSection("DeleteRemote", name); err != nil {
+		fs.Errorf(nil, "Failed to delete remote %q: %v", name, err)
 		return
 	}
-	EditRemote(fs, name)
+	SaveConfig()
 }
 
-// EditRemote gets the user to edit a remote
-func EditRemote(fs *fs.RegInfo, name string) {
-	ShowRemote(name)
-	fmt.Printf("Edit remote\n")
-	for {
-		for _, option := range fs.Options {
-			key := option.Name
-			value := FileGet(name, key)
-			fmt.Printf("Value %q = %q\n", key, value)
-			fmt.Printf("Edit? (y/n)>\n")
-			if Confirm() {
-				newValue := ChooseOption(&option)
-				configData.SetValue(name, key, newValue)
-			}
-		}
-		if OkRemote(name) {
-			break
+// deleteSection removes every key of section from the active
+// ConfigBackend, recording an audit entry (under action) of each key's
+// redacted value disappearing. It's the shared, backend-routed deletion
+// behind both DeleteRemote and CreateRemote's overwrite-on-recreate
+// step, so neither has to poke configData directly.
+func deleteSection(action, name string) error {
+	configMu.Lock()
+	olds := make(map[string]string)
+	for _, key := range getBackend().Keys(name) {
+		old, _ := getBackend().Get(name, key)
+		olds[key] = old
+	}
+	err := getBackend().DeleteSection(name)
+	configMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(olds) > 0 {
+		changes := make(map[string]AuditChange, len(olds))
+		for key, old := range olds {
+			changes[key] = redactChange(old, "", isPasswordKey(name, key))
 		}
+		Audit(action, name, changes)
 	}
-	SaveConfig()
-	RemoteConfig(name)
-}
-
-// DeleteRemote gets the user to delete a remote
-func DeleteRemote(name string) {
-	configData.DeleteSection(name)
-	SaveConfig()
+	return nil
 }
 
-// copyRemote asks the user for a new remote name and copies name into
-// it. Returns the new name.
-func copyRemote(name string) string {
-	newName := NewRemoteName()
-	// Copy the keys
-	for _, key := range configData.GetKeyList(name) {
-		value := configData.MustValue(name, key, "")
-		configData.SetValue(newName, key, value)
+// DeleteRemoteByName deletes the remote called name, returning an error
+// if it isn't configured rather than silently no-op'ing - the
+// automation-friendly counterpart to DeleteRemote for callers (eg the rc
+// layer) that need to distinguish "deleted" from "never existed".
+func DeleteRemoteByName(name string) error {
+	if _, err := findByName(name); err != nil {
+		return err
 	}
-	return newName
-}
-
-// RenameRemote renames a config section
-func RenameRemote(name string) {
-	fmt.Printf("Enter new name for %q remote.\n", name)
-	newName := copyRemote(name)
-	if name != newName {
-		configData.DeleteSection(name)
-		SaveConfig()
+	if err := deleteSection("DeleteRemote", name); err != nil {
+		return err
 	}
-}
-
-// CopyRemote copies a config section
-func CopyRemote(name string) {
-	fmt.Printf("Enter name for copy of %q remote.\n", name)
-	copyRemote(name)
 	SaveConfig()
+	return nil
 }
 
 // ShowConfigLocation prints the location of the config file in use
@@ -894,8 +1406,11 @@ func ShowConfigLocation() {
 
 // ShowConfig prints the (unencrypted) config options
 func ShowConfig() {
+	configMu.Lock()
 	var buf bytes.Buffer
-	if err := goconfig.SaveConfigData(configData, &buf); err != nil {
+	err := goconfig.SaveConfigData(configData, &buf)
+	configMu.Unlock()
+	if err != nil {
 		log.Fatalf("Failed to serialize config: %v", err)
 	}
 	str := buf.String()
@@ -905,81 +1420,6 @@ func ShowConfig() {
 	fmt.Printf("%s", str)
 }
 
-// EditConfig edits the config file interactively
-func EditConfig() {
-	for {
-		haveRemotes := len(configData.GetSectionList()) != 0
-		what := []string{"eEdit existing remote", "nNew remote", "dDelete remote", "rRename remote", "cCopy remote", "sSet configuration password", "qQuit config"}
-		if haveRemotes {
-			fmt.Printf("Current remotes:\n\n")
-			ShowRemotes()
-			fmt.Printf("\n")
-		} else {
-			fmt.Printf("No remotes found - make a new one\n")
-			// take 2nd item and last 2 items of menu list
-			what = append(what[1:2], what[len(what)-2:]...)
-		}
-		switch i := Command(what); i {
-		case 'e':
-			name := ChooseRemote()
-			fs := MustFindByName(name)
-			EditRemote(fs, name)
-		case 'n':
-			NewRemote(NewRemoteName())
-		case 'd':
-			name := ChooseRemote()
-			DeleteRemote(name)
-		case 'r':
-			RenameRemote(ChooseRemote())
-		case 'c':
-			CopyRemote(ChooseRemote())
-		case 's':
-			SetPassword()
-		case 'q':
-			return
-
-		}
-	}
-}
-
-// SetPassword will allow the user to modify the current
-// configuration encryption settings.
-func SetPassword() {
-	for {
-		if len(configKey) > 0 {
-			fmt.Println("Your configuration is encrypted.")
-			what := []string{"cChange Password", "uUnencrypt configuration", "qQuit to main menu"}
-			switch i := Command(what); i {
-			case 'c':
-				changeConfigPassword()
-				SaveConfig()
-				fmt.Println("Password changed")
-				continue
-			case 'u':
-				configKey = nil
-				SaveConfig()
-				continue
-			case 'q':
-				return
-			}
-
-		} else {
-			fmt.Println("Your configuration is not encrypted.")
-			fmt.Println("If you add a password, you will protect your login information to cloud services.")
-			what := []string{"aAdd Password", "qQuit to main menu"}
-			switch i := Command(what); i {
-			case 'a':
-				changeConfigPassword()
-				SaveConfig()
-				fmt.Println("Password set")
-				continue
-			case 'q':
-				return
-			}
-		}
-	}
-}
-
 // Authorize is for remote authorization of headless machines.
 //
 // It expects 1 or 3 arguments
@@ -1004,11 +1444,13 @@ func Authorize(args []string) {
 	defer DeleteRemote(name)
 
 	// Indicate that we want fully automatic configuration.
+	configMu.Lock()
 	configData.SetValue(name, ConfigAutomatic, "yes")
 	if len(args) == 3 {
 		configData.SetValue(name, ConfigClientID, args[1])
 		configData.SetValue(name, ConfigClientSecret, args[2])
 	}
+	configMu.Unlock()
 	fs.Config(name)
 }
 
@@ -1022,71 +1464,137 @@ func configToEnv(section, name string) string {
 // FileGet gets the config key under section returning the
 // default or empty string if not set.
 //
-// It looks up defaults in the environment if they are present
+// It looks up defaults in the environment if they are present, then
+// falls back to the active ConfigBackend (see RCLONE_CONFIG_BACKEND).
 func FileGet(section, key string, defaultVal ...string) string {
 	envKey := configToEnv(section, key)
-	newValue, found := os.LookupEnv(envKey)
-	if found {
-		defaultVal = []string{newValue}
+	if newValue, found := os.LookupEnv(envKey); found {
+		return newValue
 	}
-	return configData.MustValue(section, key, defaultVal...)
+	configMu.Lock()
+	value, ok := getBackend().Get(section, key)
+	configMu.Unlock()
+	if ok {
+		return value
+	}
+	if len(defaultVal) > 0 {
+		return defaultVal[0]
+	}
+	return ""
 }
 
 // FileGetBool gets the config key under section returning the
 // default or false if not set.
 //
-// It looks up defaults in the environment if they are present
+// It looks up defaults in the environment if they are present, then
+// falls back to the active ConfigBackend (see RCLONE_CONFIG_BACKEND).
 func FileGetBool(section, key string, defaultVal ...bool) bool {
 	envKey := configToEnv(section, key)
-	newValue, found := os.LookupEnv(envKey)
-	if found {
+	if newValue, found := os.LookupEnv(envKey); found {
 		newBool, err := strconv.ParseBool(newValue)
 		if err != nil {
 			fs.Errorf(nil, "Couldn't parse %q into bool - ignoring: %v", envKey, err)
 		} else {
-			defaultVal = []bool{newBool}
+			return newBool
+		}
+	}
+	configMu.Lock()
+	value, ok := getBackend().Get(section, key)
+	configMu.Unlock()
+	if ok {
+		newBool, err := strconv.ParseBool(value)
+		if err != nil {
+			fs.Errorf(nil, "Couldn't parse %q into bool - ignoring: %v", value, err)
+		} else {
+			return newBool
 		}
 	}
-	return configData.MustBool(section, key, defaultVal...)
+	if len(defaultVal) > 0 {
+		return defaultVal[0]
+	}
+	return false
 }
 
 // FileGetInt gets the config key under section returning the
 // default or 0 if not set.
 //
-// It looks up defaults in the environment if they are present
+// It looks up defaults in the environment if they are present, then
+// falls back to the active ConfigBackend (see RCLONE_CONFIG_BACKEND).
 func FileGetInt(section, key string, defaultVal ...int) int {
 	envKey := configToEnv(section, key)
-	newValue, found := os.LookupEnv(envKey)
-	if found {
+	if newValue, found := os.LookupEnv(envKey); found {
 		newInt, err := strconv.Atoi(newValue)
 		if err != nil {
 			fs.Errorf(nil, "Couldn't parse %q into int - ignoring: %v", envKey, err)
 		} else {
-			defaultVal = []int{newInt}
+			return newInt
+		}
+	}
+	configMu.Lock()
+	value, ok := getBackend().Get(section, key)
+	configMu.Unlock()
+	if ok {
+		newInt, err := strconv.Atoi(value)
+		if err != nil {
+			fs.Errorf(nil, "Couldn't parse %q into int - ignoring: %v", value, err)
+		} else {
+			return newInt
 		}
 	}
-	return configData.MustInt(section, key, defaultVal...)
+	if len(defaultVal) > 0 {
+		return defaultVal[0]
+	}
+	return 0
 }
 
-// FileSet sets the key in section to value.  It doesn't save
-// the config file.
-func FileSet(section, key, value string) {
-	configData.SetValue(section, key, value)
+// FileSet sets the key in section to value in the active ConfigBackend.
+// It doesn't save the config file. The change is recorded in the audit
+// log (see Audit); the configui flows and CreateRemote, UpdateRemote and
+// PasswordRemote set every key through here. Deletions are audited by
+// FileDeleteKey and deleteSection instead, while SetValueAndSave and
+// Authorize write configData directly and are not audited. Returns an
+// error if the active backend (eg Vault, AWS Secrets Manager,
+// Kubernetes) failed to apply the write.
+func FileSet(section, key, value string) error {
+	configMu.Lock()
+	old, _ := getBackend().Get(section, key)
+	err := getBackend().Set(section, key, value)
+	configMu.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "failed to set %q/%q", section, key)
+	}
+	if old != value {
+		Audit("FileSet", section, map[string]AuditChange{key: redactChange(old, value, isPasswordKey(section, key))})
+	}
+	return nil
 }
 
-// FileDeleteKey deletes the config key in the config file.
-// It returns true if the key was deleted,
-// or returns false if the section or key didn't exist.
-func FileDeleteKey(section, key string) bool {
-	return configData.DeleteKey(section, key)
+// FileDeleteKey deletes the config key in the active ConfigBackend.
+// It returns true if the key was deleted, or false if the section or
+// key didn't exist, and an error if the active backend failed to apply
+// the deletion.
+func FileDeleteKey(section, key string) (bool, error) {
+	configMu.Lock()
+	old, _ := getBackend().Get(section, key)
+	ok, err := getBackend().DeleteKey(section, key)
+	configMu.Unlock()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to delete %q/%q", section, key)
+	}
+	if ok {
+		Audit("FileDeleteKey", section, map[string]AuditChange{key: redactChange(old, "", isPasswordKey(section, key))})
+	}
+	return ok, nil
 }
 
 var matchEnv = regexp.MustCompile(`^RCLONE_CONFIG_(.*?)_TYPE=.*$`)
 
-// FileSections returns the sections in the config file
+// FileSections returns the sections known to the active ConfigBackend,
 // including any defined by environment variables.
 func FileSections() []string {
-	sections := configData.GetSectionList()
+	configMu.Lock()
+	sections := getBackend().Sections()
+	configMu.Unlock()
 	for _, item := range os.Environ() {
 		matches := matchEnv.FindStringSubmatch(item)
 		if len(matches) == 2 {
@@ -1096,17 +1604,70 @@ func FileSections() []string {
 	return sections
 }
 
-// Dump dumps all the config as a JSON file
-func Dump() error {
-	dump := make(map[string]map[string]string)
-	for _, name := range configData.GetSectionList() {
+// FileGetKeys returns the keys under section in the active ConfigBackend.
+func FileGetKeys(section string) []string {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return getBackend().Keys(section)
+}
+
+// DumpParams returns every configured remote and its keys and values, as
+// built by Dump - factored out so callers that want the data rather than
+// JSON on stdout (eg the rc layer) don't have to round-trip through
+// encoding/json themselves. Like FileSections and FileGetKeys, it reads
+// through the active ConfigBackend rather than assuming a local file.
+func DumpParams() map[string]map[string]string {
+	configMu.Lock()
+	sections := getBackend().Sections()
+	keysBySection := make(map[string][]string, len(sections))
+	for _, name := range sections {
+		keysBySection[name] = getBackend().Keys(name)
+	}
+	configMu.Unlock()
+	dump := make(map[string]map[string]string, len(sections))
+	for _, name := range sections {
 		params := make(map[string]string)
-		for _, key := range configData.GetKeyList(name) {
+		for _, key := range keysBySection[name] {
 			params[key] = FileGet(name, key)
 		}
 		dump[name] = params
 	}
-	b, err := json.MarshalIndent(dump, "", "    ")
+	return dump
+}
+
+// RemoteValues returns the keys and values configured for the remote
+// called name, redacting password values the same way ShowRemote does
+// on the console. It returns an error rather than exiting if name isn't
+// a configured remote.
+func RemoteValues(name string) (map[string]string, error) {
+	f, err := findByName(name)
+	if err != nil {
+		return nil, err
+	}
+	configMu.Lock()
+	keys := getBackend().Keys(name)
+	configMu.Unlock()
+	values := make(map[string]string)
+	for _, key := range keys {
+		isPassword := false
+		for _, option := range f.Options {
+			if option.Name == key && option.IsPassword {
+				isPassword = true
+				break
+			}
+		}
+		value := FileGet(name, key)
+		if isPassword && value != "" {
+			value = "*** ENCRYPTED ***"
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Dump dumps all the config as a JSON file
+func Dump() error {
+	b, err := json.MarshalIndent(DumpParams(), "", "    ")
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal config dump")
 	}
@@ -1156,4 +1717,4 @@ func makeCacheDir() (dir string) {
 		dir = os.TempDir()
 	}
 	return filepath.Join(dir, "rclone")
-}
\ No newline at end of file
+}
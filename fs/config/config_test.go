@@ -0,0 +1,164 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestScryptParamsRoundTrip checks that encode/decode of scryptParams is
+// lossless, since these are the bytes cached next to the salt in a
+// RCLONE_ENCRYPT_V1 config so a config stays openable even if the
+// defaults change in a later rclone version.
+func TestScryptParamsRoundTrip(t *testing.T) {
+	want := scryptParams{logN: 16, r: 8, p: 2}
+	got := decodeScryptParams(want.encode())
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// TestWrapUnwrapMasterKey checks that a master key sealed with
+// wrapMasterKey can be recovered with the same kek, and that a wrong kek
+// is rejected rather than returning garbage.
+func TestWrapUnwrapMasterKey(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{0x42}, masterKeySize)
+	kek := bytes.Repeat([]byte{0x01}, 32)
+
+	wrapped, err := wrapMasterKey(masterKey, kek)
+	if err != nil {
+		t.Fatalf("wrapMasterKey returned an error: %v", err)
+	}
+
+	got, ok := unwrapMasterKey(wrapped, kek)
+	if !ok {
+		t.Fatal("unwrapMasterKey failed to open with the correct kek")
+	}
+	if !bytes.Equal(got, masterKey) {
+		t.Errorf("got %x, want %x", got, masterKey)
+	}
+
+	wrongKek := bytes.Repeat([]byte{0x02}, 32)
+	if _, ok := unwrapMasterKey(wrapped, wrongKek); ok {
+		t.Error("unwrapMasterKey succeeded with the wrong kek")
+	}
+}
+
+// TestUnwrapMasterKeyBadLength checks that a blob of the wrong size is
+// rejected outright rather than panicking.
+func TestUnwrapMasterKeyBadLength(t *testing.T) {
+	kek := bytes.Repeat([]byte{0x01}, 32)
+	if _, ok := unwrapMasterKey([]byte("too short"), kek); ok {
+		t.Error("unwrapMasterKey accepted a short blob")
+	}
+}
+
+// TestRunPasswordCommand checks the common case: a --password-command
+// that prints a single line of password to stdout.
+func TestRunPasswordCommand(t *testing.T) {
+	pw, err := runPasswordCommand(helperCommand(t, "password", "hunter2"))
+	if err != nil {
+		t.Fatalf("runPasswordCommand returned an error: %v", err)
+	}
+	if pw != "hunter2" {
+		t.Errorf("got password %q, want %q", pw, "hunter2")
+	}
+}
+
+// TestRunPasswordCommandTrimsTrailingCR checks a command that emits
+// Windows-style line endings still yields a clean password.
+func TestRunPasswordCommandTrimsTrailingCR(t *testing.T) {
+	pw, err := runPasswordCommand(helperCommand(t, "password-crlf", "hunter2"))
+	if err != nil {
+		t.Fatalf("runPasswordCommand returned an error: %v", err)
+	}
+	if pw != "hunter2" {
+		t.Errorf("got password %q, want %q", pw, "hunter2")
+	}
+}
+
+// TestRunPasswordCommandOnlyFirstLine checks that only the first line of
+// a multi-line command's output is used as the password.
+func TestRunPasswordCommandOnlyFirstLine(t *testing.T) {
+	pw, err := runPasswordCommand(helperCommand(t, "multiline", "hunter2", "ignored"))
+	if err != nil {
+		t.Fatalf("runPasswordCommand returned an error: %v", err)
+	}
+	if pw != "hunter2" {
+		t.Errorf("got password %q, want %q", pw, "hunter2")
+	}
+}
+
+// TestRunPasswordCommandEmptyOutput checks that a command producing no
+// output is treated as an error rather than an empty password.
+func TestRunPasswordCommandEmptyOutput(t *testing.T) {
+	_, err := runPasswordCommand(helperCommand(t, "empty"))
+	if err == nil {
+		t.Fatal("expected an error for a password command with empty output")
+	}
+}
+
+// TestRunPasswordCommandFailure checks that a non-zero exit from the
+// command is surfaced as an error.
+func TestRunPasswordCommandFailure(t *testing.T) {
+	_, err := runPasswordCommand(helperCommand(t, "fail"))
+	if err == nil {
+		t.Fatal("expected an error for a failing password command")
+	}
+}
+
+// helperCommand builds a shell command string that re-invokes this test
+// binary as a subprocess running TestHelperProcess, the same approach
+// os/exec uses to test itself - so --password-command can be exercised
+// against a predictable stand-in rather than a real external program.
+func helperCommand(t *testing.T, args ...string) string {
+	t.Helper()
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	cs := append([]string{"-test.run=TestHelperProcess", "--"}, args...)
+	parts := make([]string, 0, len(cs)+1)
+	parts = append(parts, strconv.Quote(os.Args[0]))
+	for _, a := range cs {
+		parts = append(parts, strconv.Quote(a))
+	}
+	return strings.Join(parts, " ")
+}
+
+// TestHelperProcess isn't a real test - it's run as a subprocess by
+// helperCommand to stand in for an external --password-command program.
+// It prints whatever helperCommand's scenario argument asks for, then
+// exits, rather than exercising anything in this package itself.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "password":
+		fmt.Print(args[1] + "\n")
+	case "password-crlf":
+		fmt.Print(args[1] + "\r\n")
+	case "multiline":
+		fmt.Print(args[1] + "\n" + args[2] + "\n")
+	case "empty":
+		// Deliberately no output.
+	case "fail":
+		fmt.Fprintln(os.Stderr, "simulated failure")
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown scenario %q\n", args[0])
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
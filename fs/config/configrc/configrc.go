@@ -0,0 +1,264 @@
+// Package configrc exposes fs/config over the rc (remote control) HTTP
+// API, so the rc daemon and any web UI built on it can list, inspect and
+// provision remotes the same way an rclone.conf-editing terminal session
+// would, without driving the menu in configui.
+//
+// Importing this package registers the config/* rc calls as a side
+// effect; it has no API of its own.
+package configrc
+
+import (
+	"github.com/ncw/rclone/fs"
+	"github.com/ncw/rclone/fs/config"
+	"github.com/ncw/rclone/fs/rc"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	rc.Add(rc.Call{
+		Path:  "config/list",
+		Fn:    rcList,
+		Title: "List the defined remotes",
+		Help: `Returns a JSON object mapping each configured remote name to
+its provider type, eg:
+
+    {"remotes": {"mydrive": "drive", "myftp": "ftp"}}
+`,
+	})
+	rc.Add(rc.Call{
+		Path:  "config/providers",
+		Fn:    rcProviders,
+		Title: "List the available providers and their options",
+		Help: `Returns the same provider/option metadata "rclone config providers"
+prints, for a caller that wants to build its own remote creation form.`,
+	})
+	rc.Add(rc.Call{
+		Path:  "config/get",
+		Fn:    rcGet,
+		Title: "Get the options of a remote",
+		Help: `Parameters:
+
+- name - name of remote to look up
+
+Password values are redacted as "*** ENCRYPTED ***". Returns an error if
+the remote doesn't exist.`,
+	})
+	rc.Add(rc.Call{
+		Path:  "config/create",
+		Fn:    rcCreate,
+		Title: "Create a new remote",
+		Help: `Parameters:
+
+- name - name of new remote
+- type - type of new remote
+- parameters - a map of {"key": "value"} pairs
+- opt - a dictionary of options to control the behaviour
+    - noObscure - the values in parameters are already obscured
+    - token - an OAuth token obtained out of band to store under "token"
+    - noConfigHook - don't run the provider's Config hook (eg OAuth)
+    - dryRun - return the resolved config without saving it (keys are not checked against the provider's options)
+
+Returns the resolved config that was (or, with dryRun, would be) written.`,
+	})
+	rc.Add(rc.Call{
+		Path:  "config/update",
+		Fn:    rcUpdate,
+		Title: "Update an existing remote",
+		Help:  `Takes the same parameters as config/create except type, for an existing remote.`,
+	})
+	rc.Add(rc.Call{
+		Path:  "config/password",
+		Fn:    rcPassword,
+		Title: "Set one or more password options on a remote",
+		Help: `Parameters:
+
+- name - name of remote
+- parameters - a map of {"key": "value"} pairs of plaintext passwords to
+  obscure and store
+`,
+	})
+	rc.Add(rc.Call{
+		Path:  "config/delete",
+		Fn:    rcDelete,
+		Title: "Delete a remote",
+		Help:  `Parameters: name - name of remote to delete.`,
+	})
+	rc.Add(rc.Call{
+		Path:  "config/dump",
+		Fn:    rcDump,
+		Title: "Dump all the config",
+		Help:  `Returns {"remotes": {...}} mapping each remote name to its options, as "rclone config dump" prints them.`,
+	})
+}
+
+// remoteName extracts the required "name" parameter from in.
+func remoteName(in rc.Params) (string, error) {
+	name, err := in.GetString("name")
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't find remote name")
+	}
+	return name, nil
+}
+
+// remoteParams extracts the required "parameters" map from in.
+func remoteParams(in rc.Params) (map[string]string, error) {
+	var params map[string]string
+	if err := in.GetStruct("parameters", &params); err != nil {
+		return nil, errors.Wrap(err, "couldn't find remote parameters")
+	}
+	return params, nil
+}
+
+// createOptions decodes the optional "opt" sub-object of in into a
+// config.CreateOptions, defaulting to the zero value if absent.
+func createOptions(in rc.Params) (opts config.CreateOptions, err error) {
+	ok, err := in.GetStructMissingOK("opt", &opts)
+	if !ok {
+		opts = config.CreateOptions{}
+	}
+	if err != nil {
+		return opts, errors.Wrap(err, "couldn't decode opt")
+	}
+	return opts, nil
+}
+
+// rcList implements config/list
+func rcList(in rc.Params) (out rc.Params, err error) {
+	remotes := make(map[string]string)
+	for _, name := range config.FileSections() {
+		remotes[name] = config.FileGet(name, "type")
+	}
+	return rc.Params{"remotes": remotes}, nil
+}
+
+// rcProviders implements config/providers
+func rcProviders(in rc.Params) (out rc.Params, err error) {
+	return rc.Params{"providers": fs.Registry}, nil
+}
+
+// rcGet implements config/get
+func rcGet(in rc.Params) (out rc.Params, err error) {
+	name, err := remoteName(in)
+	if err != nil {
+		return nil, err
+	}
+	values, err := config.RemoteValues(name)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Params(stringMapToParams(values)), nil
+}
+
+// rcCreate implements config/create
+func rcCreate(in rc.Params) (out rc.Params, err error) {
+	config.SetAuditActor("rc")
+	// Reset once this call is done, so a later non-rc mutation (eg the
+	// interactive config menu running in the same process) isn't
+	// mislabelled as "rc" forever.
+	defer config.SetAuditActor("")
+	name, err := remoteName(in)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := in.GetString("type")
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't find remote type")
+	}
+	params, err := remoteParams(in)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := createOptions(in)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := config.CreateRemote(name, provider, params, opts)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Params(stringMapToParams(resolved)), nil
+}
+
+// rcUpdate implements config/update
+func rcUpdate(in rc.Params) (out rc.Params, err error) {
+	config.SetAuditActor("rc")
+	// Reset once this call is done, so a later non-rc mutation (eg the
+	// interactive config menu running in the same process) isn't
+	// mislabelled as "rc" forever.
+	defer config.SetAuditActor("")
+	name, err := remoteName(in)
+	if err != nil {
+		return nil, err
+	}
+	params, err := remoteParams(in)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := createOptions(in)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := config.UpdateRemote(name, params, opts)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Params(stringMapToParams(resolved)), nil
+}
+
+// rcPassword implements config/password
+func rcPassword(in rc.Params) (out rc.Params, err error) {
+	config.SetAuditActor("rc")
+	// Reset once this call is done, so a later non-rc mutation (eg the
+	// interactive config menu running in the same process) isn't
+	// mislabelled as "rc" forever.
+	defer config.SetAuditActor("")
+	name, err := remoteName(in)
+	if err != nil {
+		return nil, err
+	}
+	params, err := remoteParams(in)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := createOptions(in)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := config.PasswordRemote(name, params, opts)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Params(stringMapToParams(resolved)), nil
+}
+
+// rcDelete implements config/delete
+func rcDelete(in rc.Params) (out rc.Params, err error) {
+	config.SetAuditActor("rc")
+	// Reset once this call is done, so a later non-rc mutation (eg the
+	// interactive config menu running in the same process) isn't
+	// mislabelled as "rc" forever.
+	defer config.SetAuditActor("")
+	name, err := remoteName(in)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.DeleteRemoteByName(name); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// rcDump implements config/dump
+func rcDump(in rc.Params) (out rc.Params, err error) {
+	return rc.Params{"remotes": config.DumpParams()}, nil
+}
+
+// stringMapToParams converts a map[string]string into the
+// map[string]interface{} that rc.Params wraps.
+func stringMapToParams(values map[string]string) map[string]interface{} {
+	out := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,545 @@
+// Package configui provides an interactive, menu-driven front end for
+// creating and editing rclone remotes.
+//
+// fs/config itself only deals with config I/O and encryption, so that
+// it can be embedded in a GUI, a web UI or an automated provisioning
+// tool without dragging in os.Stdin prompts. Everything in this
+// package that needs to ask the user something goes through the
+// Prompter interface, so a caller can supply a JSON-RPC, HTTP or
+// GUI-backed implementation instead of the default StdioPrompter -
+// analogous to how gocryptfs separates its readpassword backends
+// (stdin, extpass, fd).
+package configui
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/ncw/rclone/fs/config"
+	"github.com/ncw/rclone/fs/driveletter"
+)
+
+// Prompter asks the user questions so NewRemote, EditRemote and the
+// other interactive flows in this package can be driven by something
+// other than stdin, eg a GUI or an RPC client.
+type Prompter interface {
+	// Text asks a free-form question and returns the line entered.
+	Text(prompt string) string
+	// Choice asks the user to choose one of defaults, or type their
+	// own value if newOk is set. help, if not nil, gives one entry
+	// of explanatory text per entry in defaults.
+	Choice(what string, defaults, help []string, newOk bool) string
+	// Password asks for a password, retrying until it passes
+	// config.CheckPassword.
+	Password(prompt string) []byte
+	// Confirm asks a yes/no question.
+	Confirm() bool
+}
+
+// ReadLine reads a line of input from stdin. It is a var so tests can
+// stub it out.
+var ReadLine = func() string {
+	buf := bufio.NewReader(os.Stdin)
+	line, err := buf.ReadString('\n')
+	if err != nil {
+		log.Fatalf("Failed to read line: %v", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+// StdioPrompter is the default Prompter, driving the traditional
+// stdin/stdout menu-based UI.
+type StdioPrompter struct{}
+
+// Text asks a free-form question on stdout and reads the answer from stdin.
+func (StdioPrompter) Text(prompt string) string {
+	fmt.Printf("%s> ", prompt)
+	return ReadLine()
+}
+
+// Confirm asks the user for Yes or No and returns true or false.
+func (p StdioPrompter) Confirm() bool {
+	if fs.Config.AutoConfirm {
+		return true
+	}
+	return Command(p, []string{"yYes", "nNo"}) == 'y'
+}
+
+// Choice lists defaults (annotated with the matching entry of help, if
+// given) numbered from 1, and reads a line naming one of them, or, if
+// newOk is set, accepts arbitrary text instead.
+func (StdioPrompter) Choice(what string, defaults, help []string, newOk bool) string {
+	valueDescripton := "an existing"
+	if newOk {
+		valueDescripton = "your own"
+	}
+	fmt.Printf("Choose a number from below, or type in %s value\n", valueDescripton)
+	for i, text := range defaults {
+		var lines []string
+		if help != nil {
+			parts := strings.Split(help[i], "\n")
+			lines = append(lines, parts...)
+		}
+		lines = append(lines, fmt.Sprintf("%q", text))
+		pos := i + 1
+		if len(lines) == 1 {
+			fmt.Printf("%2d > %s\n", pos, text)
+		} else {
+			mid := (len(lines) - 1) / 2
+			for i, line := range lines {
+				var sep rune
+				switch i {
+				case 0:
+					sep = '/'
+				case len(lines) - 1:
+					sep = '\\'
+				default:
+					sep = '|'
+				}
+				number := "  "
+				if i == mid {
+					number = fmt.Sprintf("%2d", pos)
+				}
+				fmt.Printf("%s %c %s\n", number, sep, line)
+			}
+		}
+	}
+	for {
+		fmt.Printf("%s> ", what)
+		result := ReadLine()
+		i, err := strconv.Atoi(result)
+		if err != nil {
+			if newOk {
+				return result
+			}
+			for _, v := range defaults {
+				if result == v {
+					return result
+				}
+			}
+			continue
+		}
+		if i >= 1 && i <= len(defaults) {
+			return defaults[i-1]
+		}
+	}
+}
+
+// Password asks for a password with the prompt given, retrying until
+// it passes config.CheckPassword.
+func (StdioPrompter) Password(prompt string) []byte {
+	fmt.Fprintln(os.Stderr, prompt)
+	for {
+		fmt.Fprint(os.Stderr, "password:")
+		password := config.ReadPassword()
+		password, err := config.CheckPassword(password)
+		if err == nil {
+			return password
+		}
+		fmt.Fprintf(os.Stderr, "Bad password: %v\n", err)
+	}
+}
+
+// Command prints commands (each a single letter followed by its
+// description) and asks p to choose one, returning its letter.
+func Command(p Prompter, commands []string) byte {
+	opts := []string{}
+	for _, text := range commands {
+		fmt.Printf("%c) %s\n", text[0], text[1:])
+		opts = append(opts, text[:1])
+	}
+	optString := strings.Join(opts, "")
+	optHelp := strings.Join(opts, "/")
+	for {
+		result := strings.ToLower(p.Text(optHelp))
+		if len(result) != 1 {
+			continue
+		}
+		i := strings.Index(optString, string(result[0]))
+		if i >= 0 {
+			return result[0]
+		}
+	}
+}
+
+// ChooseNumber asks p to enter a number between min and max inclusive,
+// prompting with what.
+func ChooseNumber(p Prompter, what string, min, max int) int {
+	for {
+		result := p.Text(what)
+		i, err := strconv.Atoi(result)
+		if err != nil {
+			fmt.Printf("Bad number: %v\n", err)
+			continue
+		}
+		if i < min || i > max {
+			fmt.Printf("Out of range - %d to %d inclusive\n", min, max)
+			continue
+		}
+		return i
+	}
+}
+
+// ChooseRemote asks p to choose an existing remote name.
+func ChooseRemote(p Prompter) string {
+	remotes := config.FileSections()
+	sort.Strings(remotes)
+	return p.Choice("remote", remotes, nil, false)
+}
+
+// OkRemote shows the remote and asks p whether to keep it, edit it or
+// delete it.
+func OkRemote(p Prompter, name string) bool {
+	config.ShowRemote(name)
+	switch i := Command(p, []string{"yYes this is OK", "eEdit this remote", "dDelete this remote"}); i {
+	case 'y':
+		return true
+	case 'e':
+		return false
+	case 'd':
+		config.DeleteRemote(name)
+		return true
+	default:
+		fs.Errorf(nil, "Bad choice %c", i)
+	}
+	return false
+}
+
+// ChooseOption asks p to choose how to fill in option o, and returns
+// the value to store in the config.
+func ChooseOption(p Prompter, o *fs.Option) string {
+	fmt.Println(o.Help)
+	if o.IsPassword {
+		actions := []string{"yYes type in my own password", "gGenerate random password"}
+		if o.Optional {
+			actions = append(actions, "nNo leave this optional password blank")
+		}
+		var password string
+		switch i := Command(p, actions); i {
+		case 'y':
+			pw := ChangePassword(p, "the")
+			password = string(pw)
+			config.Zero(pw)
+		case 'g':
+			for {
+				fmt.Printf("Password strength in bits.\n64 is just about memorable\n128 is secure\n1024 is the maximum\n")
+				bits := ChooseNumber(p, "Bits", 64, 1024)
+				bytes := bits / 8
+				if bits%8 != 0 {
+					bytes++
+				}
+				var pw = make([]byte, bytes)
+				n, _ := rand.Read(pw)
+				if n != bytes {
+					log.Fatalf("password short read: %d", n)
+				}
+				password = base64.RawURLEncoding.EncodeToString(pw)
+				fmt.Printf("Your password is: %s\n", password)
+				fmt.Printf("Use this password?\n")
+				if p.Confirm() {
+					break
+				}
+			}
+		case 'n':
+			return ""
+		default:
+			fs.Errorf(nil, "Bad choice %c", i)
+		}
+		return config.MustObscure(password)
+	}
+	if len(o.Examples) > 0 {
+		var values []string
+		var help []string
+		for _, example := range o.Examples {
+			values = append(values, example.Value)
+			help = append(help, example.Help)
+		}
+		return p.Choice(o.Name, values, help, true)
+	}
+	return p.Text(o.Name)
+}
+
+// ChangePassword asks p twice for the named password; if the same
+// password is entered both times it is returned.
+func ChangePassword(p Prompter, name string) []byte {
+	for {
+		a := p.Password(fmt.Sprintf("Enter %s password:", name))
+		b := p.Password(fmt.Sprintf("Confirm %s password:", name))
+		if bytes.Equal(a, b) {
+			config.Zero(b)
+			return a
+		}
+		config.Zero(a)
+		config.Zero(b)
+		fmt.Println("Passwords do not match!")
+	}
+}
+
+// fsOption returns an Option describing the possible remotes
+func fsOption() *fs.Option {
+	o := &fs.Option{
+		Name: "Storage",
+		Help: "Type of storage to configure.",
+	}
+	for _, item := range fs.Registry {
+		example := fs.OptionExample{
+			Value: item.Name,
+			Help:  item.Description,
+		}
+		o.Examples = append(o.Examples, example)
+	}
+	o.Examples.Sort()
+	return o
+}
+
+// NewRemoteName asks p for a name for a remote
+func NewRemoteName(p Prompter) (name string) {
+	for {
+		name = p.Text("name")
+		parts := fs.Matcher.FindStringSubmatch(name + ":")
+		switch {
+		case name == "":
+			fmt.Printf("Can't use empty name.\n")
+		case driveletter.IsDriveLetter(name):
+			fmt.Printf("Can't use %q as it can be confused a drive letter.\n", name)
+		case parts == nil:
+			fmt.Printf("Can't use %q as it has invalid characters in it.\n", name)
+		default:
+			return name
+		}
+	}
+}
+
+// NewRemote makes a new remote from its name, asking p for the type
+// and the value of each option.
+func NewRemote(p Prompter, name string) {
+	newType := ChooseOption(p, fsOption())
+	if err := config.FileSet(name, "type", newType); err != nil {
+		fmt.Printf("Failed to set type: %v\n", err)
+		return
+	}
+	f := fs.MustFind(newType)
+	for _, option := range f.Options {
+		if err := config.FileSet(name, option.Name, ChooseOption(p, &option)); err != nil {
+			fmt.Printf("Failed to set %q: %v\n", option.Name, err)
+			return
+		}
+	}
+	config.RemoteConfig(name)
+	// Record this as a single NewRemote action distinct from the
+	// per-key FileSet entries above, so the audit log can answer "was
+	// this remote created via NewRemote" rather than just listing the
+	// individual keys that were set.
+	config.Audit("NewRemote", name, nil)
+	if OkRemote(p, name) {
+		config.SaveConfig()
+		return
+	}
+	EditRemote(p, f, name)
+}
+
+// EditRemote gets p to edit a remote
+func EditRemote(p Prompter, f *fs.RegInfo, name string) {
+	config.ShowRemote(name)
+	fmt.Printf("Edit remote\n")
+	for {
+		for _, option := range f.Options {
+			key := option.Name
+			value := config.FileGet(name, key)
+			fmt.Printf("Value %q = %q\n", key, value)
+			fmt.Printf("Edit? (y/n)>\n")
+			if p.Confirm() {
+				newValue := ChooseOption(p, &option)
+				if err := config.FileSet(name, key, newValue); err != nil {
+					fmt.Printf("Failed to set %q: %v\n", key, err)
+				}
+			}
+		}
+		if OkRemote(p, name) {
+			break
+		}
+	}
+	config.SaveConfig()
+	config.RemoteConfig(name)
+	// Record this as a single EditRemote action distinct from the
+	// per-key FileSet entries above.
+	config.Audit("EditRemote", name, nil)
+}
+
+// copyRemote asks p for a new remote name and copies name into it.
+// Returns the new name.
+func copyRemote(p Prompter, name string) string {
+	newName := NewRemoteName(p)
+	// Copy the keys
+	for _, key := range config.FileGetKeys(name) {
+		value := config.FileGet(name, key)
+		if err := config.FileSet(newName, key, value); err != nil {
+			fmt.Printf("Failed to set %q: %v\n", key, err)
+			return newName
+		}
+	}
+	return newName
+}
+
+// RenameRemote renames a config section
+func RenameRemote(p Prompter, name string) {
+	fmt.Printf("Enter new name for %q remote.\n", name)
+	newName := copyRemote(p, name)
+	if name != newName {
+		config.DeleteRemote(name)
+	}
+	// Record this as a single RenameRemote action distinct from the
+	// per-key FileSet and the DeleteRemote entries copyRemote/DeleteRemote
+	// produce on their own.
+	config.Audit("RenameRemote", name, map[string]config.AuditChange{"name": {Old: name, New: newName}})
+}
+
+// CopyRemote copies a config section
+func CopyRemote(p Prompter, name string) {
+	fmt.Printf("Enter name for copy of %q remote.\n", name)
+	newName := copyRemote(p, name)
+	config.SaveConfig()
+	// Record this as a single CopyRemote action distinct from the
+	// per-key FileSet entries copyRemote produces on its own.
+	config.Audit("CopyRemote", name, map[string]config.AuditChange{"name": {Old: name, New: newName}})
+}
+
+// EditConfig edits the config file interactively, driven by p
+func EditConfig(p Prompter) {
+	for {
+		haveRemotes := len(config.FileSections()) != 0
+		what := []string{"eEdit existing remote", "nNew remote", "dDelete remote", "rRename remote", "cCopy remote", "sSet configuration password", "qQuit config"}
+		if haveRemotes {
+			fmt.Printf("Current remotes:\n\n")
+			config.ShowRemotes()
+			fmt.Printf("\n")
+		} else {
+			fmt.Printf("No remotes found - make a new one\n")
+			// take 2nd item and last 2 items of menu list
+			what = append(what[1:2], what[len(what)-2:]...)
+		}
+		switch i := Command(p, what); i {
+		case 'e':
+			name := ChooseRemote(p)
+			f := config.MustFindByName(name)
+			EditRemote(p, f, name)
+		case 'n':
+			NewRemote(p, NewRemoteName(p))
+		case 'd':
+			name := ChooseRemote(p)
+			config.DeleteRemote(name)
+		case 'r':
+			RenameRemote(p, ChooseRemote(p))
+		case 'c':
+			CopyRemote(p, ChooseRemote(p))
+		case 's':
+			SetPassword(p)
+		case 'q':
+			return
+
+		}
+	}
+}
+
+// SetPassword lets p modify the current configuration encryption settings.
+func SetPassword(p Prompter) {
+	for {
+		if config.IsEncrypted() {
+			fmt.Println("Your configuration is encrypted.")
+			what := []string{"cChange Password", "uUnencrypt configuration", "mBind to this machine", "rAdd recovery passphrase", "qQuit to main menu"}
+			if config.IsMachineBound() || config.IsTPMBound() {
+				what[2] = "mRe-bind to this machine (rotate machine key)"
+			}
+			switch i := Command(p, what); i {
+			case 'c':
+				changeConfigPassword(p)
+				config.SaveConfig()
+				fmt.Println("Password changed")
+				continue
+			case 'u':
+				config.ClearConfigPassword()
+				config.SaveConfig()
+				continue
+			case 'm':
+				bindMachineKey(p)
+				continue
+			case 'r':
+				addRecoveryPassphrase(p)
+				continue
+			case 'q':
+				return
+			}
+
+		} else {
+			fmt.Println("Your configuration is not encrypted.")
+			fmt.Println("If you add a password, you will protect your login information to cloud services.")
+			what := []string{"aAdd Password", "mBind to this machine", "qQuit to main menu"}
+			switch i := Command(p, what); i {
+			case 'a':
+				changeConfigPassword(p)
+				config.SaveConfig()
+				fmt.Println("Password set")
+				continue
+			case 'm':
+				bindMachineKey(p)
+				continue
+			case 'q':
+				return
+			}
+		}
+	}
+}
+
+// bindMachineKey seals the master key to this machine's OS keychain (or
+// its TPM, if p confirms) instead of a password, so an unattended
+// daemon can decrypt rclone.conf here without a passphrase prompt.
+func bindMachineKey(p Prompter) {
+	fmt.Println("This will let rclone decrypt its configuration on this machine without a password.")
+	fmt.Println("Seal to a TPM 2.0 chip instead of the OS keychain?")
+	var err error
+	if p.Confirm() {
+		err = config.BindTPMKey()
+	} else {
+		err = config.BindMachineKey()
+	}
+	if err != nil {
+		fmt.Printf("Failed to bind machine key: %v\n", err)
+		return
+	}
+	config.SaveConfig()
+	fmt.Println("Configuration bound to this machine.")
+	fmt.Println("Consider also adding a recovery passphrase in case this machine is lost.")
+}
+
+// addRecoveryPassphrase asks p for a recovery passphrase and wraps the
+// master key under it, in a sidecar file next to the config, so a
+// machine- or TPM-bound config can still be opened elsewhere.
+func addRecoveryPassphrase(p Prompter) {
+	password := ChangePassword(p, "recovery")
+	defer config.Zero(password)
+	if err := config.AddRecoveryPassphrase(password); err != nil {
+		fmt.Printf("Failed to set recovery passphrase: %v\n", err)
+		return
+	}
+	fmt.Println("Recovery passphrase set.")
+}
+
+// changeConfigPassword asks p twice for a password and uses it to
+// establish a brand new master key (if none exists yet) or to rewrap
+// the existing one.
+func changeConfigPassword(p Prompter) {
+	newPassword := ChangePassword(p, "NEW configuration")
+	defer config.Zero(newPassword)
+	if err := config.ChangeConfigPassword(newPassword); err != nil {
+		fmt.Printf("Failed to set config password: %v\n", err)
+	}
+}
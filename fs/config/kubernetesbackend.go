@@ -0,0 +1,218 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// kubernetesConfigBackendMountPath is the directory a Kubernetes Secret
+// (or projected volume of several Secrets) is mounted at, one
+// subdirectory per remote and one file per key - the usual shape for
+// secrets mounted into a pod. Used when --config-kubernetes-namespace
+// isn't set.
+var kubernetesConfigBackendMountPath = pflag.StringP("config-kubernetes-mount-path", "", "/var/run/secrets/rclone", "Directory a mounted Kubernetes Secret volume is read from")
+
+// kubernetesConfigBackendNamespace selects the Kubernetes API mode
+// instead of the mounted-volume mode: each remote is stored as its own
+// Secret object, named after it, in this namespace. This is required
+// for Set/DeleteKey to work, since a mounted volume is read-only.
+var kubernetesConfigBackendNamespace = pflag.StringP("config-kubernetes-namespace", "", "", "Kubernetes namespace to store remotes' Secrets in - enables read/write via the API instead of a read-only mounted volume")
+
+// kubernetesConfigBackend stores remotes as Kubernetes Secrets, either
+// read back from a mounted volume (read-only - the common case for an
+// unattended daemon that should never need write access to the
+// cluster) or, if --config-kubernetes-namespace is set, read and
+// written through the API directly. Selected with --config-backend
+// kubernetes or RCLONE_CONFIG_BACKEND=kubernetes.
+type kubernetesConfigBackend struct {
+	mountPath string
+	namespace string
+	clientset *kubernetes.Clientset
+}
+
+// newKubernetesConfigBackend creates a kubernetesConfigBackend. If
+// --config-kubernetes-namespace is set it builds an in-cluster API
+// client; otherwise it just remembers the mount path to read from.
+func newKubernetesConfigBackend() (ConfigBackend, error) {
+	b := &kubernetesConfigBackend{
+		mountPath: *kubernetesConfigBackendMountPath,
+		namespace: *kubernetesConfigBackendNamespace,
+	}
+	if b.namespace == "" {
+		return b, nil
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load in-cluster Kubernetes config")
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Kubernetes client")
+	}
+	b.clientset = clientset
+	return b, nil
+}
+
+// usingAPI reports whether b is using the Kubernetes API (read/write)
+// rather than a mounted volume (read-only).
+func (b *kubernetesConfigBackend) usingAPI() bool {
+	return b.clientset != nil
+}
+
+func (b *kubernetesConfigBackend) secretClient() typedSecretInterface {
+	return b.clientset.CoreV1().Secrets(b.namespace)
+}
+
+// typedSecretInterface is the subset of corev1.SecretInterface used
+// here, named locally so it's obvious at a glance what this package
+// depends on from client-go.
+type typedSecretInterface interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error)
+	Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error)
+	Update(ctx context.Context, secret *corev1.Secret, opts metav1.UpdateOptions) (*corev1.Secret, error)
+	List(ctx context.Context, opts metav1.ListOptions) (*corev1.SecretList, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+func (b *kubernetesConfigBackend) Get(section, key string) (string, bool) {
+	if b.usingAPI() {
+		secret, err := b.secretClient().Get(context.Background(), section, metav1.GetOptions{})
+		if err != nil {
+			return "", false
+		}
+		value, ok := secret.StringData[key]
+		if !ok {
+			data, has := secret.Data[key]
+			if !has {
+				return "", false
+			}
+			return string(data), true
+		}
+		return value, true
+	}
+	data, err := ioutil.ReadFile(filepath.Join(b.mountPath, section, key))
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func (b *kubernetesConfigBackend) Set(section, key, value string) error {
+	if !b.usingAPI() {
+		return errors.Errorf("can't write %q/%q - kubernetes config backend is read-only without --config-kubernetes-namespace", section, key)
+	}
+	client := b.secretClient()
+	secret, err := client.Get(context.Background(), section, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: section, Namespace: b.namespace},
+			StringData: map[string]string{},
+		}
+		secret.StringData[key] = value
+		_, err := client.Create(context.Background(), secret, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if secret.StringData == nil {
+		secret.StringData = map[string]string{}
+	}
+	secret.StringData[key] = value
+	_, err = client.Update(context.Background(), secret, metav1.UpdateOptions{})
+	return err
+}
+
+func (b *kubernetesConfigBackend) DeleteKey(section, key string) (bool, error) {
+	if !b.usingAPI() {
+		return false, errors.Errorf("can't delete %q/%q - kubernetes config backend is read-only without --config-kubernetes-namespace", section, key)
+	}
+	client := b.secretClient()
+	secret, err := client.Get(context.Background(), section, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	if _, ok := secret.StringData[key]; !ok {
+		if _, ok := secret.Data[key]; !ok {
+			return false, nil
+		}
+		delete(secret.Data, key)
+	} else {
+		delete(secret.StringData, key)
+	}
+	if _, err := client.Update(context.Background(), secret, metav1.UpdateOptions{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *kubernetesConfigBackend) DeleteSection(section string) error {
+	if !b.usingAPI() {
+		return errors.Errorf("can't delete %q - kubernetes config backend is read-only without --config-kubernetes-namespace", section)
+	}
+	return b.secretClient().Delete(context.Background(), section, metav1.DeleteOptions{})
+}
+
+func (b *kubernetesConfigBackend) Sections() []string {
+	if b.usingAPI() {
+		list, err := b.secretClient().List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return nil
+		}
+		sections := make([]string, 0, len(list.Items))
+		for _, secret := range list.Items {
+			sections = append(sections, secret.Name)
+		}
+		return sections
+	}
+	entries, err := ioutil.ReadDir(b.mountPath)
+	if err != nil {
+		return nil
+	}
+	var sections []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			sections = append(sections, entry.Name())
+		}
+	}
+	return sections
+}
+
+func (b *kubernetesConfigBackend) Keys(section string) []string {
+	if b.usingAPI() {
+		secret, err := b.secretClient().Get(context.Background(), section, metav1.GetOptions{})
+		if err != nil {
+			return nil
+		}
+		keys := make([]string, 0, len(secret.StringData)+len(secret.Data))
+		for k := range secret.StringData {
+			keys = append(keys, k)
+		}
+		for k := range secret.Data {
+			if _, ok := secret.StringData[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(b.mountPath, section))
+	if err != nil {
+		return nil
+	}
+	var keys []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			keys = append(keys, entry.Name())
+		}
+	}
+	return keys
+}
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/zalando/go-keyring"
+)
+
+// machineKeyService is the service name BindMachineKey's KEK is stored
+// under in the OS secret store (macOS Keychain, Windows Credential
+// Manager, or the Secret Service via libsecret on Linux - go-keyring
+// picks whichever applies to the current GOOS).
+const machineKeyService = "rclone-config"
+
+// machineKeyAccount identifies which config this machine-bound KEK
+// belongs to, so more than one rclone.conf on the same machine (eg a
+// test config) doesn't collide in the keychain.
+func machineKeyAccount() string {
+	return ConfigPath
+}
+
+// loadMachineKEK returns the KEK stashed by BindMachineKey, if any.
+func loadMachineKEK() ([]byte, bool) {
+	encoded, err := keyring.Get(machineKeyService, machineKeyAccount())
+	if err != nil {
+		return nil, false
+	}
+	kek, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	return kek, true
+}
+
+// saveMachineKEK stashes kek in the OS secret store.
+func saveMachineKEK(kek []byte) error {
+	return keyring.Set(machineKeyService, machineKeyAccount(), base64.StdEncoding.EncodeToString(kek))
+}
+
+// IsMachineBound returns true if the config's master key is currently
+// sealed to this machine's OS keychain rather than a user password.
+func IsMachineBound() bool {
+	_, ok := loadMachineKEK()
+	return ok
+}
+
+// BindMachineKey seals the config's master key (creating one first if
+// the config isn't encrypted yet) under a freshly generated KEK stored
+// in the OS keychain/credential store, instead of one derived from a
+// password. An unattended daemon can then decrypt rclone.conf on this
+// machine without ever being asked for a passphrase. Call
+// AddRecoveryPassphrase too if the config also needs to be readable
+// somewhere this machine's keychain isn't available - eg after a
+// reinstall, or to restore onto different hardware.
+//
+// Machine-binding and TPM-binding are alternatives, not composable, so
+// this also removes any existing TPM binding - otherwise the stale
+// sealed blob would still be picked up (and fail to unwrap) the next
+// time loadConfigFile looks for a KEK.
+func BindMachineKey() error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if len(configMasterKey) == 0 {
+		masterKey, err := newMasterKey()
+		if err != nil {
+			return err
+		}
+		configMasterKey = masterKey
+	}
+	kek, err := newMasterKey() // masterKeySize (32 bytes) doubles as a KEK size
+	if err != nil {
+		return err
+	}
+	if err := saveMachineKEK(kek); err != nil {
+		return errors.Wrap(err, "failed to store machine key")
+	}
+	if err := UnbindTPMKey(); err != nil {
+		return errors.Wrap(err, "failed to remove superseded TPM key")
+	}
+	configKey = kek
+	configWrappedMasterKey = nil
+	return nil
+}
+
+// RotateMachineKey replaces the KEK stored in the OS keychain with a
+// freshly generated one and rewraps the existing master key under it.
+// Use this to respond to a suspected keychain compromise without having
+// to re-encrypt the whole config body.
+func RotateMachineKey() error {
+	if !IsMachineBound() {
+		return errors.New("config is not bound to this machine - nothing to rotate")
+	}
+	return BindMachineKey()
+}
+
+// UnbindMachineKey removes the KEK from the OS keychain. The caller must
+// call ChangeConfigPassword (or AddRecoveryPassphrase followed by
+// RecoverConfig) before the next SaveConfig, or the config will become
+// unreadable once the in-memory configKey is gone.
+func UnbindMachineKey() error {
+	if err := keyring.Delete(machineKeyService, machineKeyAccount()); err != nil && err != keyring.ErrNotFound {
+		return errors.Wrap(err, "failed to remove machine key")
+	}
+	return nil
+}
+
+// recoveryFileSuffix is appended to ConfigPath to name the sidecar file
+// AddRecoveryPassphrase writes and RecoverConfig reads.
+const recoveryFileSuffix = ".recovery"
+
+// AddRecoveryPassphrase wraps the current master key a second time,
+// under a key derived from password with a fresh salt, and writes the
+// result to a small sidecar file next to the main config
+// (ConfigPath+".recovery"). This lets a config bound to one machine's
+// keychain still be recovered - by RecoverConfig, given the same
+// passphrase - on different hardware, eg after the original machine is
+// lost.
+func AddRecoveryPassphrase(password []byte) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if len(configMasterKey) == 0 {
+		return errors.New("no master key established yet - bind the machine key or set a config password first")
+	}
+	salt, err := newScryptSalt()
+	if err != nil {
+		return err
+	}
+	params := defaultScryptParams()
+	// Keep the main config's KEK, salt and params - the recovery key
+	// only goes into the sidecar file.
+	oldKey, oldSalt, oldParams := configKey, configSalt, configScryptParams
+	if err := setConfigPasswordWithSalt(password, salt, params); err != nil {
+		return err
+	}
+	defer func() {
+		Zero(configKey)
+		configKey, configSalt, configScryptParams = oldKey, oldSalt, oldParams
+	}()
+	wrapped, err := wrapMasterKey(configMasterKey, configKey)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	buf = append(buf, salt...)
+	buf = append(buf, params.encode()...)
+	buf = append(buf, wrapped...)
+	return ioutil.WriteFile(ConfigPath+recoveryFileSuffix, []byte(base64.StdEncoding.EncodeToString(buf)), 0600)
+}
+
+// RecoverConfig reads the sidecar file written by AddRecoveryPassphrase,
+// unwraps the master key with password, and re-establishes the config
+// with a brand new password-derived KEK (ie it migrates the config back
+// off machine-binding onto the recovery passphrase). Use this to restore access to
+// rclone.conf on a machine other than the one it was bound to.
+func RecoverConfig(password []byte) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	raw, err := ioutil.ReadFile(ConfigPath + recoveryFileSuffix)
+	if err != nil {
+		return errors.Wrap(err, "failed to read recovery file")
+	}
+	buf, err := base64.StdEncoding.DecodeString(string(raw))
+	if err != nil {
+		return errors.Wrap(err, "failed to decode recovery file")
+	}
+	if len(buf) < scryptSaltSize+scryptParamsSize+wrappedMasterKeySize {
+		return errors.New("recovery file is corrupt or truncated")
+	}
+	salt := buf[:scryptSaltSize]
+	params := decodeScryptParams(buf[scryptSaltSize : scryptSaltSize+scryptParamsSize])
+	wrapped := buf[scryptSaltSize+scryptParamsSize:]
+	if err := setConfigPasswordWithSalt(password, salt, params); err != nil {
+		return err
+	}
+	masterKey, ok := unwrapMasterKey(wrapped, configKey)
+	if !ok {
+		Zero(configKey)
+		configKey = nil
+		return errors.New("wrong recovery passphrase")
+	}
+	configMasterKey = masterKey
+	// Re-establish the config under a brand new password-derived KEK
+	// rather than reusing the recovery one, the same way ChangeConfigPassword
+	// always rotates the salt.
+	if err := setConfigPassword(password); err != nil {
+		return err
+	}
+	if err := UnbindMachineKey(); err != nil {
+		return errors.Wrap(err, "failed to remove superseded machine key")
+	}
+	if err := UnbindTPMKey(); err != nil {
+		return errors.Wrap(err, "failed to remove superseded TPM key")
+	}
+	configWrappedMasterKey = nil
+	return nil
+}
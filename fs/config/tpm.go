@@ -0,0 +1,233 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// tpmDevice is the TPM 2.0 character device to talk to, eg
+// /dev/tpmrm0 on Linux or \\.\TPM on Windows.
+var tpmDevice = pflag.StringP("config-tpm-device", "", "/dev/tpmrm0", "TPM 2.0 device to seal the machine key to, see BindTPMKey")
+
+// tpmPCRs are the PCRs the seal is bound to - if any of them changes
+// (eg a different kernel boots), the TPM refuses to unseal, which is
+// the point: a stolen disk can't be read on different firmware/OS state.
+var tpmPCRs = []int{0, 2, 4, 7}
+
+// tpmSealedFileSuffix names the sidecar file BindTPMKey writes the
+// sealed KEK to. Unlike the OS-keychain KEK in machinekey.go, the TPM's
+// sealed blob is itself safe to store anywhere - it's the TPM's PCR
+// state, not secrecy of the blob, that gates unsealing it - so it lives
+// next to the config rather than in a keychain entry.
+const tpmSealedFileSuffix = ".tpm"
+
+// tpmSRKTemplate is the template of the storage root key that
+// Seal/Unseal load their sealed object under.
+// tpm2.CreatePrimary is deterministic for a given template and
+// hierarchy, so re-deriving it at unseal time (rather than persisting
+// it) always yields the same parent without needing NV storage.
+var tpmSRKTemplate = tpm2.Public{
+	Type:       tpm2.AlgRSA,
+	NameAlg:    tpm2.AlgSHA256,
+	Attributes: tpm2.FlagStorageDefault,
+	RSAParameters: &tpm2.RSAParams{
+		Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+		KeyBits:   2048,
+	},
+}
+
+// openTPM opens the configured TPM device.
+func openTPM() (tpmutil.ReadWriteCloser, error) {
+	rwc, err := tpm2.OpenTPM(*tpmDevice)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open TPM device %q", *tpmDevice)
+	}
+	return rwc, nil
+}
+
+// tpmPCRSelection builds the PCR selection BindTPMKey seals to and
+// loadTPMKEK builds its unseal policy against.
+func tpmPCRSelection() tpm2.PCRSelection {
+	return tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: tpmPCRs}
+}
+
+// createTPMPrimary creates (and returns a handle to) the storage root
+// key that BindTPMKey/loadTPMKEK seal and load sealed objects under.
+// The caller must FlushContext it once done.
+func createTPMPrimary(rwc tpmutil.ReadWriteCloser) (tpmutil.Handle, error) {
+	srkHandle, _, err := tpm2.CreatePrimary(rwc, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", tpmSRKTemplate)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create TPM storage root key")
+	}
+	return srkHandle, nil
+}
+
+// encodeSealedBlob packs the private/public blob pair tpm2.Seal returns
+// into a single sidecar payload, length-prefixing each so loadTPMKEK
+// can split them back apart.
+func encodeSealedBlob(private, public []byte) []byte {
+	var buf []byte
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(private)))
+	buf = append(buf, lenBuf[:]...)
+	buf = append(buf, private...)
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(public)))
+	buf = append(buf, lenBuf[:]...)
+	buf = append(buf, public...)
+	return buf
+}
+
+// decodeSealedBlob is the inverse of encodeSealedBlob.
+func decodeSealedBlob(buf []byte) (private, public []byte, err error) {
+	if len(buf) < 4 {
+		return nil, nil, errors.New("sealed TPM blob is truncated")
+	}
+	privateLen := binary.BigEndian.Uint32(buf[:4])
+	buf = buf[4:]
+	if uint32(len(buf)) < privateLen+4 {
+		return nil, nil, errors.New("sealed TPM blob is truncated")
+	}
+	private, buf = buf[:privateLen], buf[privateLen:]
+	publicLen := binary.BigEndian.Uint32(buf[:4])
+	buf = buf[4:]
+	if uint32(len(buf)) < publicLen {
+		return nil, nil, errors.New("sealed TPM blob is truncated")
+	}
+	public = buf[:publicLen]
+	return private, public, nil
+}
+
+// BindTPMKey seals a freshly generated KEK to this machine's TPM 2.0
+// chip, bound to the current values of tpmPCRs, and writes the sealed
+// private/public blob pair to ConfigPath+".tpm". It then rewraps the
+// master key (creating one first if needed) under that KEK, the same
+// way BindMachineKey does for an OS keychain - the two are
+// alternatives, not composable, since both replace configKey with a
+// non-password-derived KEK. Binding also removes any existing machine
+// binding, since a stale keychain entry would otherwise still be
+// picked up (and fail to unwrap) the next time loadConfigFile looks
+// for a KEK.
+func BindTPMKey() error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if len(configMasterKey) == 0 {
+		masterKey, err := newMasterKey()
+		if err != nil {
+			return err
+		}
+		configMasterKey = masterKey
+	}
+	kek, err := newMasterKey()
+	if err != nil {
+		return err
+	}
+	rwc, err := openTPM()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rwc.Close() }()
+	srkHandle, err := createTPMPrimary(rwc)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tpm2.FlushContext(rwc, srkHandle) }()
+	private, public, err := tpm2.Seal(rwc, srkHandle, "", "", tpmPCRSelection(), kek)
+	if err != nil {
+		return errors.Wrap(err, "failed to seal key to TPM")
+	}
+	sealed := base64.StdEncoding.EncodeToString(encodeSealedBlob(private, public))
+	if err := ioutil.WriteFile(ConfigPath+tpmSealedFileSuffix, []byte(sealed), 0600); err != nil {
+		return errors.Wrap(err, "failed to write sealed TPM key")
+	}
+	if err := UnbindMachineKey(); err != nil {
+		return errors.Wrap(err, "failed to remove superseded machine key")
+	}
+	configKey = kek
+	configWrappedMasterKey = nil
+	return nil
+}
+
+// loadTPMKEK unseals the KEK written by BindTPMKey, or returns false if
+// there's no sealed blob, the TPM is unavailable, or the machine's PCR
+// state no longer matches (eg because firmware or the boot kernel
+// changed) - any of which should fall back to the usual passphrase
+// flow rather than fail outright. Unsealing a PCR-policy object needs
+// the private/public blob pair reloaded into the TPM (yielding a
+// handle) and authorised with a policy session that has walked the same
+// PCRs, rather than a bare password.
+func loadTPMKEK() ([]byte, bool) {
+	encoded, err := ioutil.ReadFile(ConfigPath + tpmSealedFileSuffix)
+	if err != nil {
+		return nil, false
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, false
+	}
+	private, public, err := decodeSealedBlob(raw)
+	if err != nil {
+		return nil, false
+	}
+	rwc, err := openTPM()
+	if err != nil {
+		return nil, false
+	}
+	defer func() { _ = rwc.Close() }()
+	srkHandle, err := createTPMPrimary(rwc)
+	if err != nil {
+		return nil, false
+	}
+	defer func() { _ = tpm2.FlushContext(rwc, srkHandle) }()
+	itemHandle, _, err := tpm2.Load(rwc, srkHandle, "", public, private)
+	if err != nil {
+		return nil, false
+	}
+	defer func() { _ = tpm2.FlushContext(rwc, itemHandle) }()
+	session, _, err := tpm2.StartAuthSession(rwc, tpm2.HandleNull, tpm2.HandleNull,
+		make([]byte, 16), nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, false
+	}
+	defer func() { _ = tpm2.FlushContext(rwc, session) }()
+	if err := tpm2.PolicyPCR(rwc, session, nil, tpmPCRSelection()); err != nil {
+		return nil, false
+	}
+	kek, err := tpm2.UnsealWithSession(rwc, session, itemHandle, "")
+	if err != nil {
+		return nil, false
+	}
+	return kek, true
+}
+
+// IsTPMBound returns true if BindTPMKey has sealed a key for this config.
+func IsTPMBound() bool {
+	_, err := ioutil.ReadFile(ConfigPath + tpmSealedFileSuffix)
+	return err == nil
+}
+
+// UnbindTPMKey removes the sealed KEK sidecar file. The caller must call
+// ChangeConfigPassword (or AddRecoveryPassphrase followed by
+// RecoverConfig) before the next SaveConfig, or the config will become
+// unreadable once the in-memory configKey is gone.
+func UnbindTPMKey() error {
+	if err := os.Remove(ConfigPath + tpmSealedFileSuffix); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove sealed TPM key")
+	}
+	return nil
+}
+
+// RotateTPMKey reseals a freshly generated KEK and rewraps the master
+// key under it, replacing the previous sealed blob.
+func RotateTPMKey() error {
+	if !IsTPMBound() {
+		return errors.New("config is not bound to a TPM - nothing to rotate")
+	}
+	return BindTPMKey()
+}
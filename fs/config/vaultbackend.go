@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// vaultConfigBackendPath is the path prefix, under the KV v2 mount,
+// that remotes are stored under - eg secret/data/<path>/<remote>.
+var vaultConfigBackendPath = pflag.StringP("config-vault-path", "", "rclone", "Path prefix under the Vault KV v2 mount used to store remotes")
+
+// vaultConfigBackend stores each remote as a KV v2 secret in HashiCorp
+// Vault, keyed by remote name, so credentials never touch local disk.
+// It is selected with --config-backend vault or RCLONE_CONFIG_BACKEND=vault.
+type vaultConfigBackend struct {
+	client *vaultapi.Client
+	path   string
+}
+
+// newVaultConfigBackend creates a vaultConfigBackend from the standard
+// Vault environment variables (VAULT_ADDR, VAULT_TOKEN, ...).
+func newVaultConfigBackend() (ConfigBackend, error) {
+	client, err := vaultapi.NewClient(vaultapi.DefaultConfig())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Vault client")
+	}
+	return &vaultConfigBackend{client: client, path: *vaultConfigBackendPath}, nil
+}
+
+// dataPath returns the KV v2 data path for section.
+func (b *vaultConfigBackend) dataPath(section string) string {
+	return fmt.Sprintf("secret/data/%s/%s", b.path, section)
+}
+
+// metadataPath returns the KV v2 metadata path used to list sections.
+func (b *vaultConfigBackend) metadataPath() string {
+	return fmt.Sprintf("secret/metadata/%s", b.path)
+}
+
+// readData reads the current KV v2 data map for section, or nil if the
+// secret doesn't exist.
+func (b *vaultConfigBackend) readData(section string) map[string]interface{} {
+	secret, err := b.client.Logical().Read(b.dataPath(section))
+	if err != nil || secret == nil {
+		return nil
+	}
+	data, _ := secret.Data["data"].(map[string]interface{})
+	return data
+}
+
+// writeData writes data as the new KV v2 data map for section.
+func (b *vaultConfigBackend) writeData(section string, data map[string]interface{}) error {
+	_, err := b.client.Logical().Write(b.dataPath(section), map[string]interface{}{"data": data})
+	return err
+}
+
+func (b *vaultConfigBackend) Get(section, key string) (string, bool) {
+	data := b.readData(section)
+	if data == nil {
+		return "", false
+	}
+	value, ok := data[key].(string)
+	return value, ok
+}
+
+func (b *vaultConfigBackend) Set(section, key, value string) error {
+	data := b.readData(section)
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data[key] = value
+	return b.writeData(section, data)
+}
+
+func (b *vaultConfigBackend) DeleteKey(section, key string) (bool, error) {
+	data := b.readData(section)
+	if _, ok := data[key]; !ok {
+		return false, nil
+	}
+	delete(data, key)
+	if err := b.writeData(section, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *vaultConfigBackend) DeleteSection(section string) error {
+	_, err := b.client.Logical().Delete(b.dataPath(section))
+	return err
+}
+
+func (b *vaultConfigBackend) Sections() []string {
+	secret, err := b.client.Logical().List(b.metadataPath())
+	if err != nil || secret == nil {
+		return nil
+	}
+	keys, _ := secret.Data["keys"].([]interface{})
+	sections := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if s, ok := k.(string); ok {
+			sections = append(sections, strings.TrimSuffix(s, "/"))
+		}
+	}
+	return sections
+}
+
+func (b *vaultConfigBackend) Keys(section string) []string {
+	data := b.readData(section)
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	return keys
+}